@@ -1,43 +1,375 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/davidbanham/required_env"
+	yaml "gopkg.in/yaml.v2"
 )
 
-var QUEUES []string
-var KEWPIE_BACKEND string
-var PORT int
+// QueueSettings holds the optional per-queue configuration. Settings are read
+// from the config file, and from env vars sharing the suffix of the queue's
+// own, eg: KEWPIE_QUEUE_FOO=foo is configured by KEWPIE_WEBHOOK_FOO
+type QueueSettings struct {
+	// The env var or config file the queue was declared in
+	Source string `yaml:"-" json:"source,omitempty"`
+	// The backend the queue is kept in, if it isn't the default one
+	Backend string `yaml:"backend" json:"backend,omitempty"`
+	// A URL each task is POSTed to as it becomes ready
+	Webhook string `yaml:"webhook" json:"webhook,omitempty"`
+	// How many times a task can fail before it is given up on. Zero is unlimited
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts,omitempty"`
+	// The queue tasks are moved to once they run out of attempts
+	DeadLetter string `yaml:"dead_letter" json:"dead_letter,omitempty"`
+	// What the body of every task published to the queue must look like
+	Schema *Schema `yaml:"schema" json:"schema,omitempty"`
+	// Which API keys can publish to, consume from and manage the queue
+	Auth *Auth `yaml:"auth" json:"auth,omitempty"`
+	// How many requests a second the queue will take
+	RateLimits *RateLimits `yaml:"rate_limits" json:"rate_limits,omitempty"`
+}
+
+// Backends are the kinds of backend queues can be kept in
+var Backends = []string{"memory", "postgres", "sqs"}
+
+func validBackend(backend string) bool {
+	for _, known := range Backends {
+		if backend == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Auth lists the API keys, by name, that are allowed to do each kind of thing
+// to a queue. Once a queue has auth settings, anything that isn't listed is
+// refused.
+type Auth struct {
+	Publish []string `yaml:"publish" json:"publish,omitempty"`
+	Consume []string `yaml:"consume" json:"consume,omitempty"`
+	Manage  []string `yaml:"manage" json:"manage,omitempty"`
+}
+
+// Scopes are the kinds of thing auth settings control
+var Scopes = []string{"publish", "consume", "manage"}
+
+// Keys are the names of the API keys allowed the scope
+func (auth Auth) Keys(scope string) []string {
+	switch scope {
+	case "publish":
+		return auth.Publish
+	case "consume":
+		return auth.Consume
+	case "manage":
+		return auth.Manage
+	}
+	return nil
+}
+
+// RateLimits caps how often a queue can be published to and consumed from
+type RateLimits struct {
+	Publish *RateLimit `yaml:"publish" json:"publish,omitempty"`
+	Consume *RateLimit `yaml:"consume" json:"consume,omitempty"`
+}
+
+// RateLimit is a token bucket. It holds Burst requests, and refills at Rate a
+// second
+type RateLimit struct {
+	Rate  float64 `yaml:"rate" json:"rate"`
+	Burst int     `yaml:"burst" json:"burst,omitempty"`
+}
+
+// Config is everything kewpie_http is configured with, from the config file
+// and env vars
+type Config struct {
+	// Path is the config file that was read, if there was one
+	Path              string                   `yaml:"-"`
+	Backend           string                   `yaml:"backend"`
+	Port              int                      `yaml:"port"`
+	IdempotencyWindow time.Duration            `yaml:"idempotency_window"`
+	StateFile         string                   `yaml:"state_file"`
+	AdminToken        string                   `yaml:"admin_token"`
+	APIKeys           map[string]string        `yaml:"api_keys"`
+	Queues            map[string]QueueSettings `yaml:"queues"`
+}
+
+// BackendFor is the backend the named queue is kept in
+func (conf Config) BackendFor(name string) string {
+	if backend := conf.Queues[name].Backend; backend != "" {
+		return backend
+	}
+	return conf.Backend
+}
+
+// Names are the names of the configured queues, in order
+func (conf Config) Names() []string {
+	names := []string{}
+	for name := range conf.Queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	errPortRange              = errors.New("a port between 1 and 65535 is required. Set PORT or port in the config file")
+	errIdempotencyWindowRange = errors.New("the idempotency window must be a positive duration, eg: 24h")
+	errMaxAttemptsNegative    = errors.New("max_attempts can't be negative")
+)
+
+// queueError is a problem with the named queue's settings
+type queueError struct {
+	queue string
+	err   error
+}
+
+func (err queueError) Error() string {
+	return "queue " + err.queue + ": " + err.err.Error()
+}
+
+// Errors are all the problems found with a config
+type Errors []error
+
+func (errs Errors) Error() string {
+	lines := []string{}
+	for _, err := range errs {
+		lines = append(lines, "  "+err.Error())
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
+
+// Load reads the config file named by KEWPIE_CONFIG, if there is one, then
+// applies env vars over the top of it. Every problem found is reported at once.
+func Load() (Config, error) {
+	conf := Config{
+		IdempotencyWindow: 24 * time.Hour,
+	}
+
+	if path := os.Getenv("KEWPIE_CONFIG"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return conf, Errors{fmt.Errorf("reading config file: %v", err)}
+		}
+		if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+			return conf, Errors{fmt.Errorf("reading config file %s: %v", path, err)}
+		}
+		conf.Path = path
+		for name, settings := range conf.Queues {
+			settings.Source = path
+			conf.Queues[name] = settings
+		}
+	}
+
+	if conf.APIKeys == nil {
+		conf.APIKeys = map[string]string{}
+	}
+	if conf.Queues == nil {
+		conf.Queues = map[string]QueueSettings{}
+	}
+
+	errs, superseded := applyEnv(&conf)
+
+	// Dead letter queues don't need declaring separately
+	for _, name := range conf.Names() {
+		settings := conf.Queues[name]
+		if settings.DeadLetter == "" {
+			continue
+		}
+		if _, ok := conf.Queues[settings.DeadLetter]; ok {
+			continue
+		}
+		deadLetter := QueueSettings{
+			Source: strings.Replace(settings.Source, "KEWPIE_QUEUE_", "KEWPIE_DEAD_LETTER_", 1),
+		}
+		// A backend that doesn't exist is reported against the queue that named it
+		if validBackend(settings.Backend) {
+			deadLetter.Backend = settings.Backend
+		}
+		conf.Queues[settings.DeadLetter] = deadLetter
+	}
+
+	for _, err := range conf.Validate() {
+		// A value that couldn't be parsed has already been reported
+		if !superseded[err] {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return conf, errs
+	}
+	return conf, nil
+}
 
-func init() {
-	required_env.Ensure(map[string]string{
-		"KEWPIE_BACKEND": "",
-		"PORT":           "",
-	})
+// applyEnv overrides the config with any env vars that are set. Along with the
+// env vars that couldn't be parsed, it returns the validation errors those
+// make redundant.
+func applyEnv(conf *Config) (Errors, map[error]bool) {
+	errs := Errors{}
+	superseded := map[error]bool{}
+
+	if backend := os.Getenv("KEWPIE_BACKEND"); backend != "" {
+		conf.Backend = backend
+	}
+
+	if port := os.Getenv("PORT"); port != "" {
+		parsed, err := strconv.Atoi(port)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PORT is not a valid integer: %q", port))
+			superseded[errPortRange] = true
+		} else {
+			conf.Port = parsed
+		}
+	}
+
+	if window := os.Getenv("KEWPIE_IDEMPOTENCY_WINDOW"); window != "" {
+		parsed, err := time.ParseDuration(window)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("KEWPIE_IDEMPOTENCY_WINDOW is not a valid duration, eg: 24h: %q", window))
+			superseded[errIdempotencyWindowRange] = true
+		} else {
+			conf.IdempotencyWindow = parsed
+		}
+	}
+
+	if stateFile := os.Getenv("KEWPIE_STATE_FILE"); stateFile != "" {
+		conf.StateFile = stateFile
+	}
+
+	if adminToken := os.Getenv("KEWPIE_ADMIN_TOKEN"); adminToken != "" {
+		conf.AdminToken = adminToken
+	}
 
 	for _, env := range os.Environ() {
-		if strings.Contains(env, "KEWPIE_QUEUE_") {
-			QUEUES = append(QUEUES, strings.Split(env, "=")[1])
+		parts := strings.SplitN(env, "=", 2)
+
+		if strings.HasPrefix(parts[0], "KEWPIE_API_KEY_") {
+			conf.APIKeys[strings.TrimPrefix(parts[0], "KEWPIE_API_KEY_")] = parts[1]
+			continue
+		}
+
+		if !strings.HasPrefix(parts[0], "KEWPIE_QUEUE_") {
+			continue
 		}
+
+		name := parts[1]
+		suffix := strings.TrimPrefix(parts[0], "KEWPIE_QUEUE_")
+
+		settings := conf.Queues[name]
+		settings.Source = parts[0]
+
+		if backend := os.Getenv("KEWPIE_BACKEND_" + suffix); backend != "" {
+			settings.Backend = backend
+		}
+		if webhook := os.Getenv("KEWPIE_WEBHOOK_" + suffix); webhook != "" {
+			settings.Webhook = webhook
+		}
+		if deadLetter := os.Getenv("KEWPIE_DEAD_LETTER_" + suffix); deadLetter != "" {
+			settings.DeadLetter = deadLetter
+		}
+		if maxAttempts := os.Getenv("KEWPIE_MAX_ATTEMPTS_" + suffix); maxAttempts != "" {
+			parsed, err := strconv.Atoi(maxAttempts)
+			if err != nil || parsed < 0 {
+				errs = append(errs, fmt.Errorf("KEWPIE_MAX_ATTEMPTS_%s is not a valid non-negative integer: %q", suffix, maxAttempts))
+				superseded[queueError{name, errMaxAttemptsNegative}] = true
+			} else {
+				settings.MaxAttempts = parsed
+			}
+		}
+
+		conf.Queues[name] = settings
+	}
+
+	return errs, superseded
+}
+
+// Validate checks the config hangs together
+func (conf Config) Validate() Errors {
+	errs := Errors{}
+
+	if conf.Backend == "" {
+		errs = append(errs, fmt.Errorf("a backend is required. Set KEWPIE_BACKEND or backend in the config file"))
+	} else if !validBackend(conf.Backend) {
+		errs = append(errs, fmt.Errorf("backend %q isn't one of %s", conf.Backend, strings.Join(Backends, ", ")))
+	}
+	if conf.Port < 1 || conf.Port > 65535 {
+		errs = append(errs, errPortRange)
+	}
+	if conf.IdempotencyWindow <= 0 {
+		errs = append(errs, errIdempotencyWindowRange)
 	}
 
-	if len(QUEUES) == 0 {
-		fmt.Println("ERROR no queues configured. Set env vars in the form KEWPIE_QUEUE_FOO=foo_bar")
+	for _, name := range conf.Names() {
+		settings := conf.Queues[name]
+		for _, err := range settings.Validate(name) {
+			errs = append(errs, queueError{name, err})
+		}
+		if settings.Auth == nil {
+			continue
+		}
+		for _, scope := range Scopes {
+			for _, key := range settings.Auth.Keys(scope) {
+				if _, ok := conf.APIKeys[key]; !ok {
+					errs = append(errs, queueError{name, fmt.Errorf("%s auth refers to an API key called %s that isn't configured", scope, key)})
+				}
+			}
+		}
 	}
 
-	fmt.Printf("INFO handling queues: %+v \n", QUEUES)
+	return errs
+}
 
-	var err error
+// Validate checks the settings make sense for the named queue on their own
+func (settings QueueSettings) Validate(name string) Errors {
+	errs := Errors{}
 
-	PORT, err = strconv.Atoi(os.Getenv("PORT"))
-	if err != nil {
-		fmt.Println("ERROR PORT is not a valid integer")
-		panic(err)
+	if settings.Backend != "" && !validBackend(settings.Backend) {
+		errs = append(errs, fmt.Errorf("backend %q isn't one of %s", settings.Backend, strings.Join(Backends, ", ")))
+	}
+	if settings.MaxAttempts < 0 {
+		errs = append(errs, errMaxAttemptsNegative)
+	}
+	if settings.DeadLetter != "" && settings.DeadLetter == name {
+		errs = append(errs, fmt.Errorf("a queue can't be its own dead letter queue"))
+	}
+	if settings.Webhook != "" {
+		target, err := url.Parse(settings.Webhook)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook must be an http or https URL"))
+		}
+	}
+	if settings.Schema != nil {
+		for _, err := range settings.Schema.Check("schema") {
+			errs = append(errs, err)
+		}
+	}
+	if settings.RateLimits != nil {
+		// In a fixed order, so the errors are too
+		for _, scoped := range []struct {
+			scope string
+			limit *RateLimit
+		}{
+			{"publish", settings.RateLimits.Publish},
+			{"consume", settings.RateLimits.Consume},
+		} {
+			scope, limit := scoped.scope, scoped.limit
+			if limit == nil {
+				continue
+			}
+			if limit.Rate <= 0 {
+				errs = append(errs, fmt.Errorf("rate_limits.%s.rate must be more than zero", scope))
+			}
+			if limit.Burst < 0 {
+				errs = append(errs, fmt.Errorf("rate_limits.%s.burst can't be negative", scope))
+			}
+		}
 	}
 
-	KEWPIE_BACKEND = os.Getenv("KEWPIE_BACKEND")
+	return errs
 }
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "kewpie_config")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "kewpie.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func withEnv(t *testing.T, key, value string) func() {
+	old, had := os.LookupEnv(key)
+	assert.Nil(t, os.Setenv(key, value))
+	return func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfig(t, `
+backend: memory
+port: 9090
+idempotency_window: 1h
+api_keys:
+  producer: pkey
+queues:
+  filequeue:
+    max_attempts: 5
+    dead_letter: filequeue_dead
+    webhook: https://example.com/hook
+    schema:
+      type: object
+      required: [name]
+      properties:
+        name:
+          type: string
+          minLength: 1
+    auth:
+      publish: [producer]
+    rate_limits:
+      publish:
+        rate: 10
+        burst: 20
+`)
+	defer withEnv(t, "KEWPIE_CONFIG", path)()
+	// The env still wins over the file
+	defer withEnv(t, "KEWPIE_MAX_ATTEMPTS_FILEQUEUE", "7")()
+	defer withEnv(t, "KEWPIE_QUEUE_FILEQUEUE", "filequeue")()
+
+	conf, err := Load()
+	assert.Nil(t, err)
+
+	assert.Equal(t, time.Hour, conf.IdempotencyWindow)
+	assert.Equal(t, "pkey", conf.APIKeys["producer"])
+
+	settings := conf.Queues["filequeue"]
+	assert.Equal(t, "KEWPIE_QUEUE_FILEQUEUE", settings.Source)
+	assert.Equal(t, 7, settings.MaxAttempts)
+	assert.Equal(t, "https://example.com/hook", settings.Webhook)
+	assert.Equal(t, []string{"producer"}, settings.Auth.Publish)
+	assert.Equal(t, 10.0, settings.RateLimits.Publish.Rate)
+	assert.Equal(t, 20, settings.RateLimits.Publish.Burst)
+
+	_, ok := conf.Queues["filequeue_dead"]
+	assert.True(t, ok)
+
+	assert.Nil(t, settings.Schema.ValidateBody(`{"name": "bob"}`))
+	assert.NotNil(t, settings.Schema.ValidateBody(`{"name": ""}`))
+	assert.NotNil(t, settings.Schema.ValidateBody(`{}`))
+	assert.NotNil(t, settings.Schema.ValidateBody(`not json`))
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	path := writeConfig(t, `
+queues:
+  broken:
+    max_attempts: -1
+    dead_letter: broken
+    webhook: ftp://example.com
+    schema:
+      type: thing
+    auth:
+      consume: [nobody]
+    rate_limits:
+      consume:
+        rate: 0
+`)
+	defer withEnv(t, "KEWPIE_CONFIG", path)()
+	defer withEnv(t, "KEWPIE_BACKEND", "memory")()
+	defer withEnv(t, "PORT", "not a port")()
+	defer withEnv(t, "KEWPIE_IDEMPOTENCY_WINDOW", "a while")()
+
+	_, err := Load()
+	assert.NotNil(t, err)
+
+	errs, ok := err.(Errors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 8)
+	// Values that can't be parsed aren't also reported as out of range
+	assert.NotContains(t, err.Error(), "between 1 and 65535")
+	assert.NotContains(t, err.Error(), "must be a positive duration")
+
+	for _, expected := range []string{
+		"PORT",
+		"KEWPIE_IDEMPOTENCY_WINDOW",
+		"max_attempts",
+		"own dead letter",
+		"webhook",
+		"schema.type",
+		"nobody",
+		"rate_limits.consume.rate",
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+func TestLoadReportsBadEnvQueueSettingsOnce(t *testing.T) {
+	defer withEnv(t, "KEWPIE_BACKEND", "memory")()
+	defer withEnv(t, "PORT", "8080")()
+	defer withEnv(t, "KEWPIE_QUEUE_ONCE", "once")()
+	defer withEnv(t, "KEWPIE_MAX_ATTEMPTS_ONCE", "-1")()
+	defer withEnv(t, "KEWPIE_BACKEND_ONCE", "carrier_pigeon")()
+	defer withEnv(t, "KEWPIE_DEAD_LETTER_ONCE", "once_dead")()
+
+	_, err := Load()
+	assert.NotNil(t, err)
+
+	errs, ok := err.(Errors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 2, err.Error())
+	assert.Contains(t, err.Error(), "KEWPIE_MAX_ATTEMPTS_ONCE is not a valid non-negative integer")
+	assert.Contains(t, err.Error(), "queue once: backend \"carrier_pigeon\"")
+	assert.NotContains(t, err.Error(), "max_attempts can't be negative")
+	assert.NotContains(t, err.Error(), "queue once_dead")
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	path := writeConfig(t, `
+queues:
+  typo:
+    max_attempt: 3
+`)
+	defer withEnv(t, "KEWPIE_CONFIG", path)()
+
+	_, err := Load()
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "max_attempt"))
+}
+
+func TestSchemaValidateBody(t *testing.T) {
+	min := 1.0
+	max := 10.0
+	schema := Schema{
+		Type: "array",
+		Items: &Schema{
+			Type:    "integer",
+			Minimum: &min,
+			Maximum: &max,
+		},
+	}
+
+	assert.Nil(t, schema.ValidateBody(`[1, 2, 10]`))
+	assert.NotNil(t, schema.ValidateBody(`[1, 2.5]`))
+	assert.NotNil(t, schema.ValidateBody(`[0]`))
+	assert.NotNil(t, schema.ValidateBody(`{"not": "an array"}`))
+
+	enum := Schema{Enum: []interface{}{"red", "green"}}
+	assert.Nil(t, enum.ValidateBody(`"red"`))
+	assert.NotNil(t, enum.ValidateBody(`"blue"`))
+}
+
+func TestQueueBackends(t *testing.T) {
+	path := writeConfig(t, `
+backend: memory
+queues:
+  elsewhere:
+    backend: postgres
+    dead_letter: elsewhere_dead
+  nowhere:
+    backend: floppy
+`)
+	defer withEnv(t, "KEWPIE_CONFIG", path)()
+	// Don't let the caller's env pick the backend or leave the port unset
+	defer withEnv(t, "KEWPIE_BACKEND", "")()
+	defer withEnv(t, "PORT", "8080")()
+
+	conf, err := Load()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `backend "floppy"`)
+
+	assert.Equal(t, "postgres", conf.BackendFor("elsewhere"))
+	assert.Equal(t, "postgres", conf.BackendFor("elsewhere_dead"))
+	assert.Equal(t, "memory", conf.BackendFor("test"))
+
+	defer withEnv(t, "KEWPIE_QUEUE_NOWHERE", "nowhere")()
+	defer withEnv(t, "KEWPIE_BACKEND_NOWHERE", "sqs")()
+
+	conf, err = Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "sqs", conf.BackendFor("nowhere"))
+}
+
+func TestRateLimitErrorsInOrder(t *testing.T) {
+	settings := QueueSettings{
+		RateLimits: &RateLimits{
+			Publish: &RateLimit{Rate: 0, Burst: -1},
+			Consume: &RateLimit{Rate: -1},
+		},
+	}
+
+	for i := 0; i < 10; i++ {
+		errs := settings.Validate("limited")
+		assert.Len(t, errs, 3)
+		assert.Contains(t, errs[0].Error(), "rate_limits.publish.rate")
+		assert.Contains(t, errs[1].Error(), "rate_limits.publish.burst")
+		assert.Contains(t, errs[2].Error(), "rate_limits.consume.rate")
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Schema is the subset of JSON Schema task bodies can be checked against. A
+// queue with a schema only takes tasks whose body is JSON matching it.
+type Schema struct {
+	Type       string             `yaml:"type" json:"type,omitempty"`
+	Required   []string           `yaml:"required" json:"required,omitempty"`
+	Properties map[string]*Schema `yaml:"properties" json:"properties,omitempty"`
+	Items      *Schema            `yaml:"items" json:"items,omitempty"`
+	Enum       []interface{}      `yaml:"enum" json:"enum,omitempty"`
+	MinLength  *int               `yaml:"minLength" json:"minLength,omitempty"`
+	MaxLength  *int               `yaml:"maxLength" json:"maxLength,omitempty"`
+	Minimum    *float64           `yaml:"minimum" json:"minimum,omitempty"`
+	Maximum    *float64           `yaml:"maximum" json:"maximum,omitempty"`
+}
+
+var schemaTypes = map[string]bool{
+	"":        true,
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// Check reports anything wrong with the schema itself. Path is where it sits,
+// to say where the problems are.
+func (schema *Schema) Check(path string) Errors {
+	errs := Errors{}
+
+	if !schemaTypes[schema.Type] {
+		errs = append(errs, fmt.Errorf("%s.type %q isn't one of object, array, string, number, integer, boolean or null", path, schema.Type))
+	}
+	for _, name := range sortedKeys(schema.Properties) {
+		if schema.Properties[name] == nil {
+			errs = append(errs, fmt.Errorf("%s.properties.%s is empty", path, name))
+			continue
+		}
+		errs = append(errs, schema.Properties[name].Check(path+".properties."+name)...)
+	}
+	if schema.Items != nil {
+		errs = append(errs, schema.Items.Check(path+".items")...)
+	}
+	if schema.MinLength != nil && schema.MaxLength != nil && *schema.MinLength > *schema.MaxLength {
+		errs = append(errs, fmt.Errorf("%s.minLength is more than maxLength", path))
+	}
+	if schema.Minimum != nil && schema.Maximum != nil && *schema.Minimum > *schema.Maximum {
+		errs = append(errs, fmt.Errorf("%s.minimum is more than maximum", path))
+	}
+
+	return errs
+}
+
+// ValidateBody checks a task body is JSON matching the schema
+func (schema *Schema) ValidateBody(body string) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return fmt.Errorf("The task body must be JSON: %v", err)
+	}
+	return schema.validate("body", value)
+}
+
+func (schema *Schema) validate(path string, value interface{}) error {
+	if schema.Type != "" && typeOf(value, schema.Type) != schema.Type {
+		return fmt.Errorf("%s must be a %s", path, schema.Type)
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		encoded, _ := json.Marshal(value)
+		for _, allowed := range schema.Enum {
+			candidate, _ := json.Marshal(allowed)
+			if string(candidate) == string(encoded) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", path, schema.Enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		for _, name := range sortedKeys(schema.Properties) {
+			property, ok := v[name]
+			if !ok || schema.Properties[name] == nil {
+				continue
+			}
+			if err := schema.Properties[name].validate(path+"."+name, property); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if schema.Items == nil {
+			break
+		}
+		for i, item := range v {
+			if err := schema.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return fmt.Errorf("%s must be at least %d characters", path, *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters", path, *schema.MaxLength)
+		}
+	case float64:
+		if schema.Minimum != nil && v < *schema.Minimum {
+			return fmt.Errorf("%s must be at least %v", path, *schema.Minimum)
+		}
+		if schema.Maximum != nil && v > *schema.Maximum {
+			return fmt.Errorf("%s must be at most %v", path, *schema.Maximum)
+		}
+	}
+
+	return nil
+}
+
+// typeOf names the JSON type of a decoded value. Whole numbers are reported
+// as integers when that's what's wanted, since they're numbers too.
+func typeOf(value interface{}, want string) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case float64:
+		if want == "integer" && v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	}
+	return ""
+}
+
+func sortedKeys(properties map[string]*Schema) []string {
+	names := []string{}
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -5,6 +5,9 @@ go 1.12
 require (
 	github.com/davidbanham/kewpie_go v0.0.0-20190813234442-8590f2182a1c
 	github.com/davidbanham/required_env v0.0.0-20150902120453-a84628a4c244
+	github.com/gorilla/websocket v1.4.1
+	github.com/lib/pq v1.0.0
 	github.com/satori/go.uuid v1.2.0
 	github.com/stretchr/testify v1.3.0
+	gopkg.in/yaml.v2 v2.4.0
 )
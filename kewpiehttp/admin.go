@@ -0,0 +1,197 @@
+package kewpiehttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+
+	"github.com/davidbanham/kewpie_go/types"
+	"github.com/paidright/kewpie_http/config"
+)
+
+// queueNamePattern keeps runtime queue names to ones every backend can use as
+// a table or queue name
+var queueNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// adminOnly requires requests to carry the admin token as a bearer token
+func (s *server) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken() == "" {
+			errRes(w, r, http.StatusForbidden, "Admin endpoints are disabled. Set KEWPIE_ADMIN_TOKEN to enable them", nil)
+			return
+		}
+
+		if !s.isAdmin(bearerToken(r)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errRes(w, r, http.StatusUnauthorized, "A valid admin token is required as a bearer token in the Authorization header", nil)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+type jsonAPIQueueSettingsPayload struct {
+	Data struct {
+		Attributes config.QueueSettings `json:"attributes"`
+	} `json:"data"`
+}
+
+func (s *server) validateQueueSettings(name string, settings config.QueueSettings) error {
+	if !queueNamePattern.MatchString(name) {
+		return errors.New("Queue names can only have letters, numbers, dashes and underscores, and be up to 64 long")
+	}
+	if errs := settings.Validate(name); len(errs) > 0 {
+		return errs[0]
+	}
+	if settings.DeadLetter != "" && !s.knownQueue(settings.DeadLetter) {
+		return fmt.Errorf("There is no queue called %s to use as a dead letter queue", settings.DeadLetter)
+	}
+	if settings.Auth != nil {
+		for _, scope := range config.Scopes {
+			for _, key := range settings.Auth.Keys(scope) {
+				if !s.hasAPIKey(key) {
+					return fmt.Errorf("There is no API key called %s to allow to %s", key, scope)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *server) registerQueueHandler(w http.ResponseWriter, r *http.Request) {
+	s.registerLock.Lock()
+	defer s.registerLock.Unlock()
+
+	name := pathParam(r, "name")
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, "Error receiving payload", err)
+		return
+	}
+
+	// Settings are optional, so an empty body registers a plain queue
+	settings := config.QueueSettings{}
+	if len(bytes) > 0 {
+		if r.Header.Get("Content-Type") == "application/vnd.api+json" {
+			payload := jsonAPIQueueSettingsPayload{}
+			err = json.Unmarshal(bytes, &payload)
+			settings = payload.Data.Attributes
+		} else {
+			err = json.Unmarshal(bytes, &settings)
+		}
+		if err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error decoding payload", err)
+			return
+		}
+	}
+
+	if err := s.validateQueueSettings(name, settings); err != nil {
+		errRes(w, r, http.StatusUnprocessableEntity, err.Error(), err)
+		return
+	}
+
+	created, err := s.queue.register(name, settings)
+	if err == errDeclaredQueue || err == errBackendChanged {
+		errRes(w, r, http.StatusConflict, err.Error(), err)
+		return
+	}
+	if err == errBackendNotConnected {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error registering queue with the backend", err)
+		return
+	}
+
+	settings, _ = s.queue.settingsFor(name)
+	if err := s.state.update(func(saved *serverState) {
+		saved.Queues[name] = settings
+	}); err != nil {
+		if created {
+			s.queue.unregister(name)
+		}
+		errRes(w, r, http.StatusInternalServerError, "Error saving queue", err)
+		return
+	}
+
+	s.startWebhook(s.ctx, name)
+
+	if created {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+	}
+	sendQueue(w, r, s.describeQueue(name))
+}
+
+func (s *server) unregisterQueueHandler(w http.ResponseWriter, r *http.Request) {
+	s.registerLock.Lock()
+	defer s.registerLock.Unlock()
+
+	name := pathParam(r, "name")
+
+	info := s.describeQueue(name)
+
+	switch err := s.queue.unregister(name); err {
+	case nil:
+	case types.QueueNotFound:
+		errRes(w, r, http.StatusNotFound, "There is no queue called "+name, err)
+		return
+	case errDeclaredQueue:
+		errRes(w, r, http.StatusConflict, err.Error(), err)
+		return
+	default:
+		// It's no longer being served either way, so carry on and forget it
+		log.Println("WARN error disconnecting unregistered queue", name, err)
+	}
+
+	if err := s.state.update(func(saved *serverState) {
+		delete(saved.Queues, name)
+		delete(saved.Paused, name)
+	}); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error saving queue", err)
+		return
+	}
+
+	info.Paused = false
+	info.PausedAt = nil
+	sendQueue(w, r, info)
+}
+
+// syncQueues brings the queues registered at runtime into line with the saved
+// state, which other processes may have changed. It returns the queues that
+// were registered or changed, so their webhooks can be started.
+func (s *server) syncQueues() []string {
+	current, _ := s.state.watch()
+
+	synced := []string{}
+	for name, settings := range current.Queues {
+		if running, ok := s.queue.settingsFor(name); ok && reflect.DeepEqual(running, settings) {
+			continue
+		}
+		if _, err := s.queue.register(name, settings); err != nil {
+			log.Println("ERROR failed to register queue from state", name, err)
+			continue
+		}
+		synced = append(synced, name)
+	}
+
+	for _, name := range s.queue.names() {
+		settings, _ := s.queue.settingsFor(name)
+		if _, ok := current.Queues[name]; ok || settings.Source != runtimeSource {
+			continue
+		}
+		if err := s.queue.unregister(name); err != nil {
+			log.Println("WARN error disconnecting unregistered queue", name, err)
+		}
+	}
+
+	return synced
+}
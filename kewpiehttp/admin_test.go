@@ -0,0 +1,209 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAdminToken = "sekrit"
+
+func init() {
+	testServer.conf.AdminToken = testAdminToken
+}
+
+func TestRegisterQueue(t *testing.T) {
+	req, err := http.NewRequest("PUT", "/queues/runtimetest", strings.NewReader(`{"max_attempts": 3, "dead_letter": "dlqtest"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	info := queueInfo{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.Equal(t, "runtimetest", info.Name)
+	assert.Equal(t, runtimeSource, info.Source)
+	assert.Equal(t, 3, info.MaxAttempts)
+
+	current, _ := testServer.state.watch()
+	assert.Equal(t, 3, current.Queues["runtimetest"].MaxAttempts)
+
+	pubreq, err := http.NewRequest("POST", "/queues/runtimetest", strings.NewReader(`{"body": "registered at runtime"}`))
+	assert.Nil(t, err)
+	pubreq.Header.Set("Content-Type", "application/json")
+
+	pubrr := httptest.NewRecorder()
+	Router()(pubrr, pubreq)
+	assert.Equal(t, http.StatusCreated, pubrr.Code)
+
+	subreq, err := http.NewRequest("GET", "/queues/runtimetest?wait=5s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+	assert.Equal(t, http.StatusOK, subrr.Code)
+	task := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(subrr.Body.Bytes(), &task))
+	assert.Equal(t, "registered at runtime", task.Body)
+
+	// Registering it again replaces its settings
+	againrr := httptest.NewRecorder()
+	againreq, err := http.NewRequest("PUT", "/admin/queues/runtimetest", strings.NewReader(""))
+	assert.Nil(t, err)
+	againreq.Header.Set("Authorization", "Bearer "+testAdminToken)
+	Router()(againrr, againreq)
+	assert.Equal(t, http.StatusOK, againrr.Code)
+	settings, _ := testServer.queue.settingsFor("runtimetest")
+	assert.Equal(t, 0, settings.MaxAttempts)
+
+	delreq, err := http.NewRequest("DELETE", "/admin/queues/runtimetest", nil)
+	assert.Nil(t, err)
+	delreq.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	delrr := httptest.NewRecorder()
+	Router()(delrr, delreq)
+	assert.Equal(t, http.StatusOK, delrr.Code)
+
+	gonerr := httptest.NewRecorder()
+	Router()(gonerr, subreq)
+	assert.Equal(t, http.StatusNotFound, gonerr.Code)
+
+	current, _ = testServer.state.watch()
+	_, ok := current.Queues["runtimetest"]
+	assert.False(t, ok)
+}
+
+func TestRegisterQueueInvalid(t *testing.T) {
+	for path, body := range map[string]string{
+		"/queues/bad%20name":     ``,
+		"/queues/badsettings":    `{"max_attempts": -1}`,
+		"/queues/baddeadletter":  `{"dead_letter": "nosuchqueue"}`,
+		"/admin/queues/badhook":  `{"webhook": "ftp://example.com"}`,
+		"/admin/queues/selfdead": `{"dead_letter": "selfdead"}`,
+	} {
+		req, err := http.NewRequest("PUT", path, strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code, path)
+	}
+
+	req, err := http.NewRequest("PUT", "/queues/test", strings.NewReader(""))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	delreq, err := http.NewRequest("DELETE", "/admin/queues/test", nil)
+	assert.Nil(t, err)
+	delreq.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	delrr := httptest.NewRecorder()
+	Router()(delrr, delreq)
+	assert.Equal(t, http.StatusConflict, delrr.Code)
+}
+
+func TestRegisterQueueUnconnectedBackend(t *testing.T) {
+	// Nothing in the tests is kept in sqs, so it was never connected
+	req, err := http.NewRequest("PUT", "/admin/queues/unconnected", strings.NewReader(`{"backend": "sqs"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.False(t, testServer.knownQueue("unconnected"))
+}
+
+func TestAdminAuth(t *testing.T) {
+	for _, token := range []string{"", "Bearer wrong"} {
+		req, err := http.NewRequest("PUT", "/queues/unauthorised", nil)
+		assert.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+	}
+
+	assert.False(t, testServer.knownQueue("unauthorised"))
+}
+
+func TestRegistryHealthy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, backend := range testServer.queue.health(ctx) {
+		assert.True(t, backend.Healthy, backend.Backend)
+	}
+	assert.Nil(t, testServer.queue.backendFor("nosuchqueue"))
+	assert.NotNil(t, testServer.queue.backendFor("test"))
+}
+
+func TestRegisteredQueuesShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kewpie_http_state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Two processes sharing their state
+	replicas := []*server{}
+	for i := 0; i < 2; i++ {
+		q := &kewpie.Kewpie{}
+		assert.Nil(t, q.Connect("memory", []string{}))
+		replicas = append(replicas, New(q, WithContext(ctx), WithConfig(config.Config{
+			Backend:    "memory",
+			StateFile:  filepath.Join(dir, "state.json"),
+			AdminToken: testAdminToken,
+		})).(*server))
+	}
+
+	req, err := http.NewRequest("PUT", "/admin/queues/sharedtest", strings.NewReader(`{"max_attempts": 3}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	rr := httptest.NewRecorder()
+	replicas[0].ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	assert.False(t, replicas[1].knownQueue("sharedtest"))
+	replicas[1].refreshState(ctx)
+	assert.True(t, replicas[1].knownQueue("sharedtest"))
+	settings, _ := replicas[1].queue.settingsFor("sharedtest")
+	assert.Equal(t, 3, settings.MaxAttempts)
+
+	delreq, err := http.NewRequest("DELETE", "/admin/queues/sharedtest", nil)
+	assert.Nil(t, err)
+	delreq.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	delrr := httptest.NewRecorder()
+	replicas[0].ServeHTTP(delrr, delreq)
+	assert.Equal(t, http.StatusOK, delrr.Code)
+
+	replicas[1].refreshState(ctx)
+	assert.False(t, replicas[1].knownQueue("sharedtest"))
+}
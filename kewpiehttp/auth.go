@@ -0,0 +1,95 @@
+package kewpiehttp
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+func (s *server) adminToken() string {
+	return s.config().AdminToken
+}
+
+func (s *server) hasAPIKey(name string) bool {
+	_, ok := s.config().APIKeys[name]
+	return ok
+}
+
+// bearerToken is the token in the Authorization header, if there is one
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// keyName finds which configured API key a token is, if any
+func (s *server) keyName(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	found := ""
+	for name, key := range s.config().APIKeys {
+		// Check every key so the time taken doesn't give away which matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+func (s *server) isAdmin(token string) bool {
+	admin := s.adminToken()
+	return admin != "" && subtle.ConstantTimeCompare([]byte(token), []byte(admin)) == 1
+}
+
+// authorised requires an API key allowed the scope on the queue. Queues
+// without auth settings are open to everyone, and the admin token is allowed
+// everything.
+func (s *server) authorised(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings, _ := s.queue.settingsFor(queueName(r))
+		if settings.Auth == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		token := bearerToken(r)
+		if s.isAdmin(token) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		name, ok := s.keyName(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			errRes(w, r, http.StatusUnauthorized, "A valid API key is required as a bearer token in the Authorization header", nil)
+			return
+		}
+
+		for _, allowed := range settings.Auth.Keys(scope) {
+			if allowed == name {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		errRes(w, r, http.StatusForbidden, "That API key isn't allowed to "+scope+" on this queue", nil)
+	})
+}
+
+// publishes guards routes that put tasks on a queue
+func (s *server) publishes(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authorised("publish", s.rateLimited("publish", handler))
+}
+
+// consumes guards routes that take tasks off a queue
+func (s *server) consumes(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authorised("consume", s.rateLimited("consume", s.unlessPaused(handler)))
+}
+
+// manages guards routes that look after a queue and the tasks on it
+func (s *server) manages(handler http.HandlerFunc) http.HandlerFunc {
+	return s.authorised("manage", handler)
+}
@@ -0,0 +1,131 @@
+package kewpiehttp
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/paidright/kewpie_http/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	testServer.conf.APIKeys["producer"] = "producerkey"
+	testServer.conf.APIKeys["consumer"] = "consumerkey"
+
+	for name, settings := range map[string]config.QueueSettings{
+		"authtest": {
+			Auth: &config.Auth{
+				Publish: []string{"producer"},
+				Consume: []string{"consumer"},
+			},
+		},
+		"schematest": {
+			Schema: &config.Schema{
+				Type:     "object",
+				Required: []string{"email"},
+				Properties: map[string]*config.Schema{
+					"email": {Type: "string"},
+				},
+			},
+		},
+		"ratelimittest": {
+			RateLimits: &config.RateLimits{
+				Publish: &config.RateLimit{Rate: 0.01, Burst: 2},
+			},
+		},
+	} {
+		if _, err := testServer.queue.register(name, settings); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func publishAs(t *testing.T, queueName, token, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/queues/"+queueName, strings.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+	return rr
+}
+
+func TestAuth(t *testing.T) {
+	body := `{"body": "secret stuff"}`
+
+	rr := publishAs(t, "authtest", "", body)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+
+	rr = publishAs(t, "authtest", "wrongkey", body)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = publishAs(t, "authtest", "consumerkey", body)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = publishAs(t, "authtest", "producerkey", body)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	// Nobody was given manage, but the admin token can do anything
+	req, err := http.NewRequest("DELETE", "/queues/authtest", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer consumerkey")
+	rr = httptest.NewRecorder()
+	Router()(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr = httptest.NewRecorder()
+	Router()(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Queues without auth settings stay open
+	rr = publishAs(t, "test", "", body)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+}
+
+func TestSchema(t *testing.T) {
+	rr := publishAs(t, "schematest", "", `{"body": "{\"email\": \"someone@example.com\"}"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	rr = publishAs(t, "schematest", "", `{"body": "{\"name\": \"someone\"}"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), "body.email is required")
+
+	rr = publishAs(t, "schematest", "", `{"body": "not json"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// A body can't be changed to one that doesn't match after publishing
+	req, err := http.NewRequest("PATCH", "/queues/schematest/tasks/"+uuid.NewV4().String(), strings.NewReader(`{"body": "{\"name\": \"someone\"}"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	Router()(rr, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), "body.email is required")
+}
+
+func TestRateLimit(t *testing.T) {
+	body := `{"body": "limited"}`
+
+	assert.Equal(t, http.StatusCreated, publishAs(t, "ratelimittest", "", body).Code)
+	assert.Equal(t, http.StatusCreated, publishAs(t, "ratelimittest", "", body).Code)
+
+	rr := publishAs(t, "ratelimittest", "", body)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	// Consuming isn't limited
+	req, err := http.NewRequest("GET", "/queues/ratelimittest", nil)
+	assert.Nil(t, err)
+	rr = httptest.NewRecorder()
+	Router()(rr, req)
+	assert.NotEqual(t, http.StatusTooManyRequests, rr.Code)
+}
@@ -0,0 +1,246 @@
+package kewpiehttp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+)
+
+var errFailedDependency = errors.New("Not published because another task in the batch failed")
+
+// publishResult reports what happened to one task in a batch
+type publishResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type jsonAPIReportPayload struct {
+	Errors []map[string]string        `json:"errors"`
+	Data   []jsonAPIData              `json:"data"`
+	Meta   map[string][]publishResult `json:"meta"`
+}
+
+func (s *server) validateTask(queueName string, task kewpie.Task) error {
+	if task.Delay < 0 {
+		return errors.New("Delay can't be negative")
+	}
+	return s.checkSchema(queueName, task.Body)
+}
+
+// checkSchema checks a task body against the named queue's schema, if it has
+// one
+func (s *server) checkSchema(queueName string, body string) error {
+	if settings, _ := s.queue.settingsFor(queueName); settings.Schema != nil {
+		return settings.Schema.ValidateBody(body)
+	}
+	return nil
+}
+
+func published(i int, task kewpie.Task, replayed bool) publishResult {
+	res := publishResult{
+		Index:  i,
+		ID:     task.ID,
+		Status: http.StatusCreated,
+	}
+	if replayed {
+		res.Status = http.StatusOK
+	}
+	return res
+}
+
+func unpublished(i int, status int, err error) publishResult {
+	return publishResult{
+		Index:  i,
+		Status: status,
+		Error:  err.Error(),
+	}
+}
+
+// publishBatch publishes each task in turn, carrying on past any that fail.
+// It returns the result for each task along with the overall status.
+func (s *server) publishBatch(ctx context.Context, queueName string, pending []pendingTask) ([]publishResult, int) {
+	results := []publishResult{}
+	status := http.StatusCreated
+
+	for i := range pending {
+		if err := s.validateTask(queueName, pending[i].Task); err != nil {
+			results = append(results, unpublished(i, http.StatusUnprocessableEntity, err))
+			status = http.StatusMultiStatus
+			continue
+		}
+
+		replayed, err := s.publish(ctx, queueName, &pending[i])
+		if err != nil {
+			results = append(results, unpublished(i, http.StatusInternalServerError, err))
+			status = http.StatusMultiStatus
+			continue
+		}
+
+		results = append(results, published(i, pending[i].Task, replayed))
+	}
+
+	return results, status
+}
+
+// publishAtomic validates every task before publishing any of them. On
+// postgres they're all published in one transaction, so either all of them
+// make it or none do. Other backends have no transactions, so a failure part
+// way through leaves the tasks before it published.
+func (s *server) publishAtomic(ctx context.Context, queueName string, pending []pendingTask) ([]publishResult, int) {
+	results := []publishResult{}
+	status := http.StatusCreated
+
+	for i := range pending {
+		if err := s.validateTask(queueName, pending[i].Task); err != nil {
+			results = append(results, unpublished(i, http.StatusUnprocessableEntity, err))
+			status = http.StatusUnprocessableEntity
+			continue
+		}
+		results = append(results, unpublished(i, http.StatusFailedDependency, errFailedDependency))
+	}
+	if status != http.StatusCreated {
+		return results, status
+	}
+
+	var tx *sql.Tx
+	txCtx := ctx
+	pg := s.pgFor(queueName)
+	if pg != nil {
+		var err error
+		tx, err = pg.BeginTx(ctx, nil)
+		if err != nil {
+			for i := range results {
+				results[i] = unpublished(i, http.StatusInternalServerError, err)
+			}
+			return results, http.StatusInternalServerError
+		}
+		// The postgres backend publishes with whatever it finds under "tx"
+		txCtx = context.WithValue(ctx, "tx", tx)
+	}
+
+	replayed := make([]bool, len(pending))
+	// releaseBefore gives up the keys of the tasks before i that the
+	// transaction was going to publish
+	releaseBefore := func(i int) {
+		for j := 0; j < i; j++ {
+			if !replayed[j] {
+				s.release(ctx, queueName, pending[j])
+			}
+		}
+	}
+	for i := range pending {
+		if j := earlierKey(pending, i); j >= 0 {
+			// It's already reserved by the earlier task, so don't wait on it
+			pending[i].Task = pending[j].Task
+			replayed[i] = true
+			results[i] = published(i, pending[i].Task, true)
+			continue
+		}
+
+		var err error
+		replayed[i], err = s.reserve(ctx, queueName, &pending[i])
+		if err == nil && !replayed[i] {
+			err = s.queue.Publish(txCtx, queueName, &pending[i].Task)
+			if err != nil {
+				s.release(ctx, queueName, pending[i])
+			}
+		}
+		if err != nil {
+			results[i] = unpublished(i, http.StatusInternalServerError, err)
+			if tx != nil {
+				tx.Rollback()
+				releaseBefore(i)
+				for j := 0; j < i; j++ {
+					results[j] = unpublished(j, http.StatusFailedDependency, errFailedDependency)
+				}
+			} else {
+				// Without a transaction the tasks before it stay published
+				for j := 0; j < i; j++ {
+					if !replayed[j] {
+						s.remember(ctx, queueName, pending[j])
+					}
+				}
+			}
+			return results, http.StatusInternalServerError
+		}
+		results[i] = published(i, pending[i].Task, replayed[i])
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			releaseBefore(len(pending))
+			for i := range results {
+				results[i] = unpublished(i, http.StatusInternalServerError, err)
+			}
+			return results, http.StatusInternalServerError
+		}
+	}
+
+	for i := range pending {
+		if !replayed[i] {
+			s.remember(ctx, queueName, pending[i])
+		}
+	}
+
+	return results, status
+}
+
+// earlierKey is the index of an earlier task with the same idempotency key as
+// the one at i, or -1 if there isn't one
+func earlierKey(pending []pendingTask, i int) int {
+	if pending[i].IdempotencyKey == "" {
+		return -1
+	}
+	for j := 0; j < i; j++ {
+		if pending[j].IdempotencyKey == pending[i].IdempotencyKey {
+			return j
+		}
+	}
+	return -1
+}
+
+func sendReport(w http.ResponseWriter, r *http.Request, status int, pending []pendingTask, results []publishResult) {
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		w.Header().Set("Content-Type", "application/json")
+		payload := jsonAPIReportPayload{
+			Meta: map[string][]publishResult{
+				"results": results,
+			},
+		}
+		for _, res := range results {
+			if res.Error != "" {
+				payload.Errors = append(payload.Errors, map[string]string{
+					"status": strconv.Itoa(res.Status),
+					"detail": "Task " + strconv.Itoa(res.Index) + ": " + res.Error,
+				})
+				continue
+			}
+			task := pending[res.Index].Task
+			payload.Data = append(payload.Data, jsonAPIData{
+				Type:       "jobs",
+				ID:         task.ID,
+				Attributes: task,
+			})
+		}
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+			return
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		return
+	}
+}
@@ -0,0 +1,178 @@
+package kewpiehttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "atomictest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestPublishManyPartialFailure(t *testing.T) {
+	t.Parallel()
+
+	payload, err := json.Marshal([]kewpie.Task{
+		kewpie.Task{
+			Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+		},
+		kewpie.Task{
+			Body:  `{"hi": "` + uuid.NewV4().String() + `"}`,
+			Delay: -time.Minute,
+		},
+		kewpie.Task{
+			Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+		},
+	})
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", "/queues/test/publish-many", bytes.NewReader(payload))
+	assert.Nil(t, err)
+
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusMultiStatus, rr.Code)
+	res := []publishResult{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, http.StatusCreated, res[0].Status)
+	assert.NotEmpty(t, res[0].ID)
+	assert.Equal(t, http.StatusUnprocessableEntity, res[1].Status)
+	assert.Equal(t, 1, res[1].Index)
+	assert.NotEmpty(t, res[1].Error)
+	assert.Equal(t, http.StatusCreated, res[2].Status)
+}
+
+func TestPublishManyReportJSONAPI(t *testing.T) {
+	t.Parallel()
+
+	payload, err := json.Marshal(jsonAPIManyPayload{
+		Data: []jsonAPIData{
+			jsonAPIData{
+				Attributes: kewpie.Task{
+					Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+				},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", "/queues/test/publish-many?report=true", bytes.NewReader(payload))
+	assert.Nil(t, err)
+
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	req.Header.Set("Accept", "application/vnd.api+json")
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusMultiStatus, rr.Code)
+	res := jsonAPIReportPayload{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Empty(t, res.Errors)
+	assert.Equal(t, 1, len(res.Data))
+	assert.Equal(t, res.Data[0].ID, res.Meta["results"][0].ID)
+	assert.Equal(t, http.StatusCreated, res.Meta["results"][0].Status)
+}
+
+func TestPublishManyAtomic(t *testing.T) {
+	t.Parallel()
+
+	invalid, err := json.Marshal([]kewpie.Task{
+		kewpie.Task{
+			Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+		},
+		kewpie.Task{
+			Body:  `{"hi": "` + uuid.NewV4().String() + `"}`,
+			Delay: -time.Minute,
+		},
+	})
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest("POST", "/queues/atomictest/publish-many?atomic=true", bytes.NewReader(invalid))
+	assert.Nil(t, err)
+
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	res := []publishResult{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, http.StatusFailedDependency, res[0].Status)
+	assert.Empty(t, res[0].ID)
+	assert.Equal(t, http.StatusUnprocessableEntity, res[1].Status)
+
+	// Nothing should have been published
+	subreq, err := http.NewRequest("GET", "/queues/atomictest?wait=1s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+
+	assert.Equal(t, http.StatusNoContent, subrr.Code)
+
+	uniq := uuid.NewV4().String()
+	valid, err := json.Marshal([]kewpie.Task{
+		kewpie.Task{
+			Body: `{"hi": "` + uniq + `"}`,
+		},
+	})
+	assert.Nil(t, err)
+
+	validreq, err := http.NewRequest("POST", "/queues/atomictest/publish-many?atomic=true", bytes.NewReader(valid))
+	assert.Nil(t, err)
+
+	validreq.Header.Set("Content-Type", "application/json")
+
+	validrr := httptest.NewRecorder()
+	Router()(validrr, validreq)
+
+	assert.Equal(t, http.StatusCreated, validrr.Code)
+	tasks := []kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(validrr.Body.Bytes(), &tasks))
+	assert.Contains(t, tasks[0].Body, uniq)
+}
+
+func TestEmptyBody(t *testing.T) {
+	t.Parallel()
+
+	s := memoryServer(t, map[string]config.QueueSettings{
+		"emptybodytest": config.QueueSettings{},
+	})
+
+	req, err := http.NewRequest("POST", "/queues/emptybodytest", bytes.NewReader([]byte(`{"body": ""}`)))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	for _, path := range []string{"/queues/emptybodytest/publish-many", "/queues/emptybodytest/publish-many?atomic=true"} {
+		manyreq, err := http.NewRequest("POST", path, bytes.NewReader([]byte(`[{"body": ""}]`)))
+		assert.Nil(t, err)
+		manyreq.Header.Set("Content-Type", "application/json")
+
+		manyrr := httptest.NewRecorder()
+		s.ServeHTTP(manyrr, manyreq)
+		assert.Equal(t, http.StatusCreated, manyrr.Code, path)
+	}
+}
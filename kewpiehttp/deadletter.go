@@ -0,0 +1,146 @@
+package kewpiehttp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+)
+
+// Tags recorded on a task when it is moved to a dead letter queue
+const sourceQueueTag = "kewpie_source_queue"
+const lastErrorTag = "kewpie_last_error"
+
+// failed decides what happens to a task a consumer has failed to handle. It's
+// requeued until it runs out of attempts, after which it's moved to the
+// queue's dead letter queue, if it has one, or dropped.
+func (s *server) failed(queueName string, task kewpie.Task, err error) (bool, error) {
+	settings, _ := s.queue.settingsFor(queueName)
+	attempts := task.Attempts + 1
+
+	if settings.MaxAttempts == 0 || attempts < settings.MaxAttempts {
+		return true, err
+	}
+
+	if settings.DeadLetter == "" {
+		log.Println("WARN task ran out of attempts and there is no dead letter queue, dropping it", queueName, task.ID, err)
+		return false, nil
+	}
+
+	dead := task
+	dead.ID = ""
+	dead.Delay = 0
+	dead.RunAt = time.Now()
+	dead.Attempts = attempts
+	dead.Tags = kewpie.Tags{}
+	for k, v := range task.Tags {
+		dead.Tags[k] = v
+	}
+	dead.Tags[sourceQueueTag] = queueName
+	if err != nil {
+		dead.Tags[lastErrorTag] = err.Error()
+	}
+
+	if pubErr := s.queue.Publish(context.Background(), settings.DeadLetter, &dead); pubErr != nil {
+		log.Println("ERROR failed to move task to dead letter queue, requeueing it instead", queueName, settings.DeadLetter, task.ID, pubErr)
+		return true, err
+	}
+
+	log.Println("INFO task ran out of attempts, moved it to dead letter queue", queueName, settings.DeadLetter, task.ID, dead.ID)
+	return false, nil
+}
+
+const defaultRedrive = 100
+
+// redriveHandler moves tasks from a dead letter queue back to the queues they
+// came from
+func (s *server) redriveHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	max := defaultRedrive
+	if param := r.URL.Query().Get("max"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed < 1 {
+			errRes(w, r, http.StatusBadRequest, "Max must be a positive number", err)
+			return
+		}
+		max = parsed
+	}
+
+	wait, err := waitFor(r)
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if wait == 0 {
+		wait = drainWait
+	}
+
+	to := r.URL.Query().Get("to")
+	if to != "" && !s.knownQueue(to) {
+		errRes(w, r, http.StatusBadRequest, "There is no queue called "+to+" to redrive to", nil)
+		return
+	}
+
+	redriven := []kewpie.Task{}
+
+	for len(redriven) < max {
+		ctx, cancel := batchContext(r.Context(), len(redriven), wait)
+
+		// The task is only removed from the dead letter queue once it is
+		// safely back on its source queue
+		published := make(chan error, 1)
+		task, err := s.claim(ctx, queueName, func(kewpie.Task) (bool, error) {
+			if err := <-published; err != nil {
+				return true, err
+			}
+			return false, nil
+		})
+		cancel()
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if err != nil {
+			errRes(w, r, http.StatusInternalServerError, fmt.Sprintf("Error popping job from queue after redriving %d", len(redriven)), err)
+			return
+		}
+
+		target := to
+		if target == "" {
+			target = task.Tags[sourceQueueTag]
+		}
+		if target == "" {
+			err = fmt.Errorf("Task %s has no %s tag, pass a to parameter to say where it should go", task.ID, sourceQueueTag)
+			published <- err
+			errRes(w, r, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+
+		revived := task
+		revived.ID = ""
+		revived.Delay = 0
+		revived.RunAt = time.Now()
+		revived.Attempts = 0
+		revived.Tags = kewpie.Tags{}
+		for k, v := range task.Tags {
+			if k != sourceQueueTag && k != lastErrorTag {
+				revived.Tags[k] = v
+			}
+		}
+
+		err = s.queue.Publish(r.Context(), target, &revived)
+		published <- err
+		if err != nil {
+			errRes(w, r, http.StatusInternalServerError, fmt.Sprintf("Error redriving task after redriving %d", len(redriven)), err)
+			return
+		}
+
+		redriven = append(redriven, revived)
+	}
+
+	sendManyPayload(w, r, redriven)
+}
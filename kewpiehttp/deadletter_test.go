@@ -0,0 +1,116 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	for _, name := range []string{"dlqsource", "dlqtest"} {
+		if err := testServer.queue.Purge(context.Background(), name); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	t.Parallel()
+
+	fixture := kewpie.Task{
+		Body:         `{"hi": "` + uuid.NewV4().String() + `"}`,
+		NoExpBackoff: true,
+		Tags: kewpie.Tags{
+			"foo": "bar",
+		},
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "dlqsource", &fixture))
+
+	// dlqsource allows two attempts
+	for attempt := 0; attempt < 2; attempt++ {
+		subreq, err := http.NewRequest("GET", "/queues/dlqsource?lease=30s", nil)
+		assert.Nil(t, err)
+
+		subrr := httptest.NewRecorder()
+		Router()(subrr, subreq)
+
+		assert.Equal(t, http.StatusOK, subrr.Code)
+		subbed := kewpie.Task{}
+		assert.Nil(t, json.Unmarshal(subrr.Body.Bytes(), &subbed))
+		assert.Equal(t, fixture.Body, subbed.Body)
+		assert.Equal(t, attempt, subbed.Attempts)
+
+		nackreq, err := http.NewRequest("POST", "/queues/dlqsource/tasks/"+subbed.ID+"/nack?reason=broken", nil)
+		assert.Nil(t, err)
+		nackreq.Header.Set("Lease-Token", subrr.Header().Get("Lease-Token"))
+
+		nackrr := httptest.NewRecorder()
+		Router()(nackrr, nackreq)
+
+		assert.Equal(t, http.StatusOK, nackrr.Code)
+	}
+
+	emptyreq, err := http.NewRequest("GET", "/queues/dlqsource?wait=1s", nil)
+	assert.Nil(t, err)
+
+	emptyrr := httptest.NewRecorder()
+	Router()(emptyrr, emptyreq)
+
+	assert.Equal(t, http.StatusNoContent, emptyrr.Code)
+
+	deadreq, err := http.NewRequest("GET", "/queues/dlqtest?lease=30s", nil)
+	assert.Nil(t, err)
+
+	deadrr := httptest.NewRecorder()
+	Router()(deadrr, deadreq)
+
+	assert.Equal(t, http.StatusOK, deadrr.Code)
+	dead := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(deadrr.Body.Bytes(), &dead))
+	assert.Equal(t, fixture.Body, dead.Body)
+	assert.Equal(t, "dlqsource", dead.Tags[sourceQueueTag])
+	assert.Equal(t, "broken", dead.Tags[lastErrorTag])
+	assert.Equal(t, "bar", dead.Tags["foo"])
+
+	// Put it back so it can be redriven
+	nackreq, err := http.NewRequest("POST", "/queues/dlqtest/tasks/"+dead.ID+"/nack", nil)
+	assert.Nil(t, err)
+	nackreq.Header.Set("Lease-Token", deadrr.Header().Get("Lease-Token"))
+
+	nackrr := httptest.NewRecorder()
+	Router()(nackrr, nackreq)
+
+	assert.Equal(t, http.StatusOK, nackrr.Code)
+
+	redrivereq, err := http.NewRequest("POST", "/queues/dlqtest/redrive?wait=5s", nil)
+	assert.Nil(t, err)
+
+	redriverr := httptest.NewRecorder()
+	Router()(redriverr, redrivereq)
+
+	assert.Equal(t, http.StatusOK, redriverr.Code)
+	redriven := []kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(redriverr.Body.Bytes(), &redriven))
+	assert.Equal(t, 1, len(redriven))
+
+	resubreq, err := http.NewRequest("GET", "/queues/dlqsource?wait=5s", nil)
+	assert.Nil(t, err)
+
+	resubrr := httptest.NewRecorder()
+	Router()(resubrr, resubreq)
+
+	assert.Equal(t, http.StatusOK, resubrr.Code)
+	revived := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(resubrr.Body.Bytes(), &revived))
+	assert.Equal(t, fixture.Body, revived.Body)
+	assert.Equal(t, 0, revived.Attempts)
+	assert.Equal(t, "bar", revived.Tags["foo"])
+	assert.Empty(t, revived.Tags[sourceQueueTag])
+}
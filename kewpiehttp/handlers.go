@@ -0,0 +1,646 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/davidbanham/kewpie_go/types"
+)
+
+// routeTable is every route the server serves
+func (s *server) routeTable() routeTable {
+	return routeTable{
+		{"/health", methods{"GET": s.healthHandler, "HEAD": s.healthHandler}},
+		{"/healthz", methods{"GET": s.healthHandler, "HEAD": s.healthHandler}},
+		// List the configured queues and their settings
+		{"/queues", methods{"GET": s.queuesHandler}},
+		// Register queues at runtime, and unregister them. These come before the
+		// other queue routes because the queue doesn't have to exist yet
+		{"/queues/:name", methods{"PUT": s.adminOnly(s.registerQueueHandler)}},
+		{"/admin/queues/:name", methods{
+			"PUT":    s.adminOnly(s.registerQueueHandler),
+			"DELETE": s.adminOnly(s.unregisterQueueHandler),
+		}},
+		{"/queues/:queue", methods{
+			// Take a task over the wire and pass it to the backend
+			"POST": s.publishes(s.publishHandler),
+			// Serve a task and either mark it complete yolo or lease it out,
+			// optionally waiting a while for one to turn up
+			"GET": s.consumes(s.subscribeHandler),
+			// Purge the named queue
+			"DELETE": s.manages(s.purgeHandler),
+		}},
+		// Take a batch of tasks over the wire and pass them to the backend
+		{"/queues/:queue/publish-many", methods{"POST": s.publishes(s.publishManyHandler)}},
+		// Serve a batch of tasks
+		{"/queues/:queue/pop-many", methods{"GET": s.consumes(s.popManyHandler)}},
+		// Push tasks to the client as Server-Sent Events
+		{"/queues/:queue/stream", methods{"GET": s.consumes(s.streamHandler)}},
+		// Push tasks over a WebSocket and take acks back over it
+		{"/queues/:queue/socket", methods{"GET": s.consumes(s.socketHandler)}},
+		// Move dead lettered tasks back to where they came from
+		{"/queues/:queue/redrive", methods{"POST": s.manages(s.redriveHandler)}},
+		// Stop handing out tasks from a queue, and start again
+		{"/queues/:queue/pause", methods{"POST": s.manages(s.pauseHandler)}},
+		{"/queues/:queue/resume", methods{"POST": s.manages(s.resumeHandler)}},
+		// Count what's waiting, scheduled and leased out
+		{"/queues/:queue/stats", methods{"GET": s.manages(s.statsHandler)}},
+		// Look at tasks without consuming them
+		{"/queues/:queue/tasks", methods{"GET": s.manages(s.peekHandler)}},
+		// Fetch, cancel or reschedule a single task
+		{"/queues/:queue/tasks/:id", methods{
+			"GET":    s.manages(s.getTaskHandler),
+			"DELETE": s.manages(s.deleteTaskHandler),
+			"PATCH":  s.manages(s.patchTaskHandler),
+		}},
+		// Complete, requeue or extend a leased task
+		{"/queues/:queue/tasks/:id/ack", methods{"POST": s.authorised("consume", s.leaseHandler("ack"))}},
+		{"/queues/:queue/tasks/:id/nack", methods{"POST": s.authorised("consume", s.leaseHandler("nack"))}},
+		{"/queues/:queue/tasks/:id/extend", methods{"POST": s.authorised("consume", s.leaseHandler("extend"))}},
+	}
+}
+
+func (s *server) publishHandler(w http.ResponseWriter, r *http.Request) {
+	pending := pendingTask{}
+
+	if r.Header.Get("Content-Type") == "application/json" {
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error receiving payload", err)
+			return
+		}
+		if err := json.Unmarshal(bytes, &pending); err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error decoding payload", err)
+			return
+		}
+	} else if r.Header.Get("Content-Type") == "application/vnd.api+json" {
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error receiving payload", err)
+			return
+		}
+		payload := jsonAPIPendingPayload{}
+		if err := json.Unmarshal(bytes, &payload); err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error decoding payload", err)
+			return
+		}
+		pending = payload.Data.Attributes
+	} else {
+		if decoded, err := decodeForm(r.Form); err != nil {
+			errRes(w, r, http.StatusBadRequest, err.Error(), err)
+			return
+		} else if len(decoded) == 0 {
+			errRes(w, r, http.StatusBadRequest, "A task body is required", nil)
+			return
+		} else {
+			pending = decoded[0]
+		}
+	}
+
+	queueName := queueName(r)
+
+	batch := []pendingTask{pending}
+	applyIdempotencyKey(r, batch)
+	pending = batch[0]
+
+	if err := s.validateTask(queueName, pending.Task); err != nil {
+		errRes(w, r, http.StatusUnprocessableEntity, err.Error(), err)
+		return
+	}
+
+	replayed, err := s.publish(r.Context(), queueName, &pending)
+	if err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error handling task", err)
+		return
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	sendPayload(w, r, pending.Task)
+}
+
+func (s *server) publishManyHandler(w http.ResponseWriter, r *http.Request) {
+	pending := []pendingTask{}
+
+	if r.Header.Get("Content-Type") == "application/x-ndjson" {
+		s.publishNDJSON(w, r, queueName(r))
+		return
+	}
+
+	if r.Header.Get("Content-Type") == "application/json" {
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error receiving payload", err)
+			return
+		}
+		if err := json.Unmarshal(bytes, &pending); err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error decoding payload", err)
+			return
+		}
+	} else if r.Header.Get("Content-Type") == "application/vnd.api+json" {
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error receiving payload", err)
+			return
+		}
+		payload := jsonAPIPendingManyPayload{}
+		if err := json.Unmarshal(bytes, &payload); err != nil {
+			errRes(w, r, http.StatusBadRequest, "Error decoding payload", err)
+			return
+		}
+		for _, data := range payload.Data {
+			pending = append(pending, data.Attributes)
+		}
+	} else {
+		if decoded, err := decodeForm(r.Form); err != nil {
+			errRes(w, r, http.StatusBadRequest, err.Error(), err)
+			return
+		} else {
+			pending = decoded
+		}
+	}
+
+	queueName := queueName(r)
+
+	applyIdempotencyKey(r, pending)
+
+	var results []publishResult
+	var status int
+	if r.URL.Query().Get("atomic") == "true" {
+		results, status = s.publishAtomic(r.Context(), queueName, pending)
+	} else {
+		results, status = s.publishBatch(r.Context(), queueName, pending)
+	}
+
+	if status != http.StatusCreated || r.URL.Query().Get("report") == "true" {
+		if status == http.StatusCreated {
+			status = http.StatusMultiStatus
+		}
+		sendReport(w, r, status, pending, results)
+		return
+	}
+
+	tasks := []kewpie.Task{}
+	for i, res := range results {
+		if res.Status == http.StatusOK {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+		tasks = append(tasks, pending[i].Task)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	sendManyPayload(w, r, tasks)
+}
+
+func sendPayload(w http.ResponseWriter, r *http.Request, task kewpie.Task) {
+	sendPayloadMeta(w, r, task, nil)
+}
+
+func sendPayloadMeta(w http.ResponseWriter, r *http.Request, task kewpie.Task, meta map[string]string) {
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		w.Header().Set("Content-Type", "application/json")
+		payload := jsonAPIPayload{
+			Data: jsonAPIData{
+				Type:       "jobs",
+				ID:         task.ID,
+				Attributes: task,
+			},
+			Meta: meta,
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+			return
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(task); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		return
+	}
+}
+
+func sendManyPayload(w http.ResponseWriter, r *http.Request, tasks []kewpie.Task) {
+	sendManyPayloadMeta(w, r, tasks, nil)
+}
+
+func sendManyPayloadMeta(w http.ResponseWriter, r *http.Request, tasks []kewpie.Task, metas []map[string]string) {
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		w.Header().Set("Content-Type", "application/json")
+		payload := jsonAPIManyPayload{}
+		for i, task := range tasks {
+			data := jsonAPIData{
+				Type:       "jobs",
+				ID:         task.ID,
+				Attributes: task,
+			}
+			if i < len(metas) {
+				data.Meta = metas[i]
+			}
+			payload.Data = append(payload.Data, data)
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+			return
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tasks); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		return
+	}
+}
+
+type yoloHandler struct {
+	handleFunc func(types.Task) (bool, error)
+}
+
+func (h yoloHandler) Handle(t types.Task) (bool, error) {
+	return h.handleFunc(t)
+}
+
+func (s *server) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	wait, err := waitFor(r)
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	ctx := r.Context()
+	if wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	}
+
+	duration, err := leaseFor(r)
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	if duration > 0 {
+		l := s.newLease(queueName, duration)
+		if _, err := s.claim(ctx, queueName, l.hold); err != nil {
+			popErrRes(w, r, err)
+			return
+		}
+		<-l.ready
+
+		sendLease(w, r, l, s.leases.expires(l))
+		return
+	}
+
+	// Serve the task and immediately mark it complete yolo
+	task, err := s.claim(ctx, queueName, func(kewpie.Task) (bool, error) {
+		return false, nil
+	})
+	if err != nil {
+		popErrRes(w, r, err)
+		return
+	}
+
+	sendPayload(w, r, task)
+}
+
+// drainWait is how long pop-many waits for each task after the first before
+// deciding the queue has run dry
+const drainWait = 100 * time.Millisecond
+
+const maxPopMany = 500
+
+// batchContext bounds the wait for the next task in a batch. The first is
+// waited for like any other subscribe, after that we only take what's already
+// there.
+func batchContext(ctx context.Context, taken int, wait time.Duration) (context.Context, context.CancelFunc) {
+	switch {
+	case taken > 0:
+		return context.WithTimeout(ctx, drainWait)
+	case wait > 0:
+		return context.WithTimeout(ctx, wait)
+	default:
+		return context.WithCancel(ctx)
+	}
+}
+
+func (s *server) popManyHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	max := 10
+	if param := r.URL.Query().Get("max"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed < 1 || parsed > maxPopMany {
+			errRes(w, r, http.StatusBadRequest, fmt.Sprintf("Max must be a number between 1 and %d", maxPopMany), err)
+			return
+		}
+		max = parsed
+	}
+
+	wait, err := waitFor(r)
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	duration, err := leaseFor(r)
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	tasks := []kewpie.Task{}
+	metas := []map[string]string{}
+
+	for len(tasks) < max {
+		ctx, cancel := batchContext(r.Context(), len(tasks), wait)
+
+		var task kewpie.Task
+		if duration > 0 {
+			l := s.newLease(queueName, duration)
+			if _, err = s.claim(ctx, queueName, l.hold); err == nil {
+				<-l.ready
+				task = l.Task
+				w.Header().Add("Lease-Token", l.Token)
+				metas = append(metas, map[string]string{
+					"lease_token":   l.Token,
+					"lease_expires": s.leases.expires(l).Format(time.RFC3339),
+				})
+			}
+		} else {
+			task, err = s.claim(ctx, queueName, func(kewpie.Task) (bool, error) {
+				return false, nil
+			})
+		}
+		cancel()
+
+		if err != nil {
+			if len(tasks) == 0 {
+				popErrRes(w, r, err)
+				return
+			}
+			if err != context.DeadlineExceeded && err != errQueuePaused {
+				log.Println("WARN error popping job from queue, sending what we have", queueName, err)
+			}
+			break
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	sendManyPayloadMeta(w, r, tasks, metas)
+}
+
+func (s *server) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	if param := unknownPurgeParam(r.URL.Query()); param != "" {
+		errRes(w, r, http.StatusBadRequest, "Unknown purge parameter "+param+". Use matching, tag.NAME, run_after, run_before or dry_run", nil)
+		return
+	}
+
+	filter, err := filterFrom(r.URL.Query())
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	dryRun := false
+	if param := r.URL.Query().Get("dry_run"); param != "" {
+		dryRun, err = strconv.ParseBool(param)
+		if err != nil {
+			errRes(w, r, http.StatusBadRequest, "dry_run must be true or false", err)
+			return
+		}
+	}
+
+	if dryRun {
+		count, sample, err := s.previewPurge(r.Context(), queueName, filter)
+		if err == errDryRunUnsupported {
+			errRes(w, r, http.StatusNotImplemented, err.Error(), err)
+			return
+		}
+		if err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error counting tasks to purge", err)
+			return
+		}
+		sendPurgePreview(w, r, count, sample)
+		return
+	}
+
+	removed, err := s.purgeTasks(r.Context(), queueName, filter)
+	if err == errPurgeFilterUnsupported {
+		errRes(w, r, http.StatusNotImplemented, err.Error(), err)
+		return
+	}
+	if err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error purging queue", err)
+		return
+	}
+
+	sendPurged(w, r, removed)
+}
+
+func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	backends := s.queue.health(r.Context())
+	for _, backend := range backends {
+		if !backend.Healthy {
+			errRes(w, r, http.StatusInternalServerError, "Queue backend "+backend.Backend+" is unhealthy", errors.New(backend.Error))
+			return
+		}
+	}
+
+	switch r.Header.Get("Accept") {
+	case "application/json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.reportHealth(r.Context(), backends))
+		return
+	case "application/vnd.api+json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jsonAPIHealthPayload{
+			Data: jsonAPIHealthData{
+				Type:       "health",
+				ID:         s.version,
+				Attributes: s.reportHealth(r.Context(), backends),
+			},
+		})
+		return
+	}
+
+	w.Write([]byte(s.version))
+	return
+}
+
+var notImplementedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotImplemented)
+	w.Write([]byte("Not implemented"))
+	return
+})
+
+var notFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	errRes(w, r, http.StatusNotFound, "Not found", nil)
+	return
+})
+
+func errRes(w http.ResponseWriter, r *http.Request, status int, message string, err error) {
+	fmt.Println("WARN sending error to client", status, message, err)
+
+	errors := []map[string]string{}
+	errors = append(errors, map[string]string{
+		"status": strconv.Itoa(status),
+		"detail": message,
+	})
+
+	response := jsonAPIPayload{
+		Errors: errors,
+	}
+
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// popErrRes tells the client nothing turned up if a long poll ran out of time,
+// and that something went wrong otherwise
+func popErrRes(w http.ResponseWriter, r *http.Request, err error) {
+	if err == context.DeadlineExceeded && r.Context().Err() == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err == errQueuePaused {
+		errRes(w, r, http.StatusLocked, err.Error(), err)
+		return
+	}
+	errRes(w, r, http.StatusInternalServerError, "Error popping job from queue", err)
+}
+
+// leaseFor reads how long a client would like to lease tasks for. Zero means
+// they don't want a lease at all.
+func leaseFor(r *http.Request) (time.Duration, error) {
+	param := r.URL.Query().Get("lease")
+	if param == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(param)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("Lease is not a valid duration, eg: 30s")
+	}
+	return duration, nil
+}
+
+// waitFor reads how long a client is willing to wait for a task, from either a
+// wait parameter eg: 20s or a Prefer header eg: wait=20
+func waitFor(r *http.Request) (time.Duration, error) {
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		parsed, err := time.ParseDuration(wait)
+		if err != nil || parsed < 0 {
+			return 0, fmt.Errorf("Wait is not a valid duration, eg: 20s")
+		}
+		return parsed, nil
+	}
+
+	for _, pref := range strings.FieldsFunc(r.Header.Get("Prefer"), func(c rune) bool {
+		return c == ',' || c == ';'
+	}) {
+		pref = strings.TrimSpace(pref)
+		if !strings.HasPrefix(pref, "wait=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(pref, "wait="))
+		if err != nil || seconds < 0 {
+			return 0, fmt.Errorf("Prefer wait is not a valid number of seconds, eg: wait=20")
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return 0, nil
+}
+
+// queueName is the name of the queue a /queues/NAME/... request refers to
+func queueName(r *http.Request) string {
+	return pathParam(r, "queue")
+}
+
+func (s *server) knownQueue(name string) bool {
+	_, ok := s.queue.settingsFor(name)
+	return ok
+}
+
+func getVal(input []string, i int) string {
+	if len(input)-1 < i {
+		return ""
+	}
+	return input[i]
+}
+
+func decodeForm(input url.Values) ([]pendingTask, error) {
+	tasks := []pendingTask{}
+
+	for index, body := range input["body"] {
+		task := pendingTask{}
+
+		delay := getVal(input["delay"], index)
+		if delay != "" {
+			parsed, err := time.ParseDuration(delay)
+			if err != nil {
+				return tasks, fmt.Errorf("Delay is not a valid duration, eg: 1s %s", err.Error())
+			}
+			task.Delay = parsed
+		}
+
+		runAt := getVal(input["run_at"], index)
+		if runAt != "" {
+			parsed, err := time.Parse(time.RFC3339, runAt)
+			if err != nil {
+				return tasks, fmt.Errorf("Run At is not a valid RFC3339 string eg: 2006-01-02T15:04:05Z07:00 %s", err.Error())
+			}
+			task.RunAt = parsed
+		}
+
+		task.Body = body
+		task.NoExpBackoff = getVal(input["no_exp_backoff"], index) == "true"
+		task.IdempotencyKey = getVal(input["idempotency_key"], index)
+
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+type jsonAPIPayload struct {
+	Errors []map[string]string `json:"errors"`
+	Data   jsonAPIData         `json:"data"`
+	Meta   map[string]string   `json:"meta"`
+}
+
+type jsonAPIData struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id"`
+	Attributes kewpie.Task       `json:"attributes"`
+	Meta       map[string]string `json:"meta,omitempty"`
+}
+
+type jsonAPIManyPayload struct {
+	Errors []map[string]string `json:"errors"`
+	Data   []jsonAPIData       `json:"data"`
+	Meta   map[string]string   `json:"meta"`
+}
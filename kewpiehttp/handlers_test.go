@@ -1,4 +1,4 @@
-package main
+package kewpiehttp
 
 import (
 	"bytes"
@@ -13,18 +13,55 @@ import (
 	"time"
 
 	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 )
 
+// testVersion is the version the test server reports
+const testVersion = "testversion"
+
+// testServer is what the tests run against. It's configured from the env,
+// like the real thing.
+var testServer = newTestServer()
+
+func newTestServer() *server {
+	conf, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := []string{}
+	for _, name := range conf.Names() {
+		if conf.BackendFor(name) == conf.Backend {
+			names = append(names, name)
+		}
+	}
+	q := &kewpie.Kewpie{}
+	if err := q.Connect(conf.Backend, names); err != nil {
+		log.Fatal(err)
+	}
+	return New(q, WithConfig(conf), WithVersion(testVersion)).(*server)
+}
+
+// Router serves requests with the test server
+func Router() func(w http.ResponseWriter, r *http.Request) {
+	return testServer.ServeHTTP
+}
+
 func init() {
-	if err := queue.Purge(context.Background(), "pubtest"); err != nil {
+	if err := testServer.queue.Purge(context.Background(), "pubtest"); err != nil {
+		log.Fatal(err)
+	}
+	if err := testServer.queue.Purge(context.Background(), "test"); err != nil {
 		log.Fatal(err)
 	}
-	if err := queue.Purge(context.Background(), "test"); err != nil {
+	if err := testServer.queue.Purge(context.Background(), "tagstest"); err != nil {
 		log.Fatal(err)
 	}
-	if err := queue.Purge(context.Background(), "tagstest"); err != nil {
+	if err := testServer.queue.Purge(context.Background(), "waittest"); err != nil {
+		log.Fatal(err)
+	}
+	if err := testServer.queue.Purge(context.Background(), "popmanytest"); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -197,6 +234,69 @@ func TestSubscribe(t *testing.T) {
 	assert.Equal(t, res.ID, subbed.ID)
 }
 
+func TestSubscribeWait(t *testing.T) {
+	t.Parallel()
+
+	// Nothing is published, so this should give up and say so
+	subreq, err := http.NewRequest("GET", "/queues/waittest?wait=1s", nil)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+
+	assert.Equal(t, http.StatusNoContent, subrr.Code)
+	assert.True(t, time.Since(start) >= 1*time.Second)
+
+	preferreq, err := http.NewRequest("GET", "/queues/waittest", nil)
+	assert.Nil(t, err)
+	preferreq.Header.Set("Prefer", "wait=1")
+
+	preferrr := httptest.NewRecorder()
+	Router()(preferrr, preferreq)
+
+	assert.Equal(t, http.StatusNoContent, preferrr.Code)
+
+	// A client that goes away before anything turns up shouldn't consume the task
+	ctx, cancel := context.WithCancel(context.Background())
+	gonereq, err := http.NewRequest("GET", "/queues/waittest", nil)
+	assert.Nil(t, err)
+
+	gonerr := httptest.NewRecorder()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	Router()(gonerr, gonereq.WithContext(ctx))
+
+	fixture := kewpie.Task{
+		Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "waittest", &fixture))
+
+	waitreq, err := http.NewRequest("GET", "/queues/waittest?wait=5s", nil)
+	assert.Nil(t, err)
+
+	waitrr := httptest.NewRecorder()
+	Router()(waitrr, waitreq)
+
+	assert.Equal(t, http.StatusOK, waitrr.Code)
+
+	subbed := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(waitrr.Body.Bytes(), &subbed))
+	assert.Equal(t, fixture.Body, subbed.Body)
+}
+
+func TestSubscribeInvalidWait(t *testing.T) {
+	subreq, err := http.NewRequest("GET", "/queues/waittest?wait=whenever", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+
+	assert.Equal(t, http.StatusBadRequest, subrr.Code)
+}
+
 func TestPurge(t *testing.T) {
 	t.Parallel()
 
@@ -243,9 +343,9 @@ func TestPurgeMatching(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	assert.Nil(t, queue.Purge(ctx, "purgematchingtest"))
-	assert.Nil(t, queue.Publish(ctx, "purgematchingtest", &fixture))
-	assert.Nil(t, queue.Publish(ctx, "purgematchingtest", &fixture2))
+	assert.Nil(t, testServer.queue.Purge(ctx, "purgematchingtest"))
+	assert.Nil(t, testServer.queue.Publish(ctx, "purgematchingtest", &fixture))
+	assert.Nil(t, testServer.queue.Publish(ctx, "purgematchingtest", &fixture2))
 
 	purgereq, err := http.NewRequest("DELETE", "/queues/purgematchingtest?matching="+substr1, nil)
 	assert.Nil(t, err)
@@ -265,7 +365,7 @@ func TestPurgeMatching(t *testing.T) {
 		},
 	}
 
-	assert.Nil(t, queue.Pop(ctx, "purgematchingtest", handler))
+	assert.Nil(t, testServer.queue.Pop(ctx, "purgematchingtest", handler))
 	assert.True(t, fired)
 }
 
@@ -442,3 +542,160 @@ func TestPublishJSONTags(t *testing.T) {
 	assert.Equal(t, res.ID, subbed.ID)
 	assert.Equal(t, res.Tags, subbed.Tags)
 }
+
+func TestPopMany(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	bodies := []string{}
+	for i := 0; i < 3; i++ {
+		fixture := kewpie.Task{
+			Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+		}
+		assert.Nil(t, testServer.queue.Publish(ctx, "popmanytest", &fixture))
+		bodies = append(bodies, fixture.Body)
+	}
+
+	req, err := http.NewRequest("GET", "/queues/popmanytest/pop-many?max=2", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	res := []kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, 2, len(res))
+
+	leasereq, err := http.NewRequest("GET", "/queues/popmanytest/pop-many?max=5&lease=30s", nil)
+	assert.Nil(t, err)
+	leasereq.Header.Set("Accept", "application/vnd.api+json")
+
+	leaserr := httptest.NewRecorder()
+	Router()(leaserr, leasereq)
+
+	assert.Equal(t, http.StatusOK, leaserr.Code)
+	leased := jsonAPIManyPayload{}
+	assert.Nil(t, json.Unmarshal(leaserr.Body.Bytes(), &leased))
+	assert.Equal(t, 1, len(leased.Data))
+	assert.NotEmpty(t, leased.Data[0].Meta["lease_token"])
+	assert.Equal(t, leased.Data[0].Meta["lease_token"], leaserr.Header().Get("Lease-Token"))
+
+	for _, task := range append(res, leased.Data[0].Attributes) {
+		assert.Contains(t, bodies, task.Body)
+	}
+
+	emptyreq, err := http.NewRequest("GET", "/queues/popmanytest/pop-many?wait=1s", nil)
+	assert.Nil(t, err)
+
+	emptyrr := httptest.NewRecorder()
+	Router()(emptyrr, emptyreq)
+
+	assert.Equal(t, http.StatusNoContent, emptyrr.Code)
+}
+
+func TestPopManyInvalidMax(t *testing.T) {
+	req, err := http.NewRequest("GET", "/queues/popmanytest/pop-many?max=0", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestUnknownQueue(t *testing.T) {
+	t.Parallel()
+
+	req, err := http.NewRequest("POST", "/queues/nosuchqueue", strings.NewReader(`{"body": "hi"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/vnd.api+json")
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "application/vnd.api+json", rr.Header().Get("Content-Type"))
+	res := jsonAPIPayload{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, 1, len(res.Errors))
+	assert.Equal(t, "404", res.Errors[0]["status"])
+	assert.Contains(t, res.Errors[0]["detail"], "nosuchqueue")
+
+	escapedreq, err := http.NewRequest("GET", "/queues/test%2Fstream", nil)
+	assert.Nil(t, err)
+
+	escapedrr := httptest.NewRecorder()
+	Router()(escapedrr, escapedreq)
+
+	assert.Equal(t, http.StatusNotFound, escapedrr.Code)
+	assert.Contains(t, escapedrr.Body.String(), "test/stream")
+}
+
+func TestQueueNameVariants(t *testing.T) {
+	t.Parallel()
+
+	for _, path := range []string{"/queues/test/", "/queues/%74est"} {
+		req, err := http.NewRequest("POST", path, strings.NewReader(`{"body": "hi"}`))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusCreated, rr.Code, path)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	req, err := http.NewRequest("PATCH", "/queues/test", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "DELETE, GET, POST, PUT", rr.Header().Get("Allow"))
+
+	streamreq, err := http.NewRequest("POST", "/queues/test/stream", nil)
+	assert.Nil(t, err)
+
+	streamrr := httptest.NewRecorder()
+	Router()(streamrr, streamreq)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, streamrr.Code)
+	assert.Equal(t, "GET", streamrr.Header().Get("Allow"))
+}
+
+func TestUnknownRoute(t *testing.T) {
+	t.Parallel()
+
+	for _, path := range []string{"/queues/test/anything", "/queues/test/tasks/abc/finish", "/nowhere"} {
+		req, err := http.NewRequest("POST", path, strings.NewReader(`{"body": "hi"}`))
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code, path)
+		res := jsonAPIPayload{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res), path)
+		assert.Equal(t, 1, len(res.Errors), path)
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	rt := route{pattern: "/queues/:queue/tasks/:id/ack"}
+
+	params, ok := rt.match([]string{"queues", "foo", "tasks", "abc", "ack"})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"queue": "foo", "id": "abc"}, params)
+
+	_, ok = rt.match([]string{"queues", "foo", "tasks", "abc", "nack"})
+	assert.False(t, ok)
+
+	_, ok = rt.match([]string{"queues", "foo", "tasks", "abc"})
+	assert.False(t, ok)
+}
@@ -0,0 +1,309 @@
+package kewpiehttp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+)
+
+// pendingTask is a task on its way to being published, along with the key that
+// makes publishing it idempotent, if it has one
+type pendingTask struct {
+	kewpie.Task
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+type jsonAPIPendingData struct {
+	Attributes pendingTask `json:"attributes"`
+}
+
+type jsonAPIPendingPayload struct {
+	Data jsonAPIPendingData `json:"data"`
+}
+
+type jsonAPIPendingManyPayload struct {
+	Data []jsonAPIPendingData `json:"data"`
+}
+
+// reservationTimeout is how long a key is held for a publish that hasn't
+// finished before another request can take it over, in case the one holding
+// it died part way through
+const reservationTimeout = 30 * time.Second
+
+// reservationPoll is how often a request waiting on another with the same key
+// checks whether it has finished
+const reservationPoll = 50 * time.Millisecond
+
+// pruneInterval is how often the memory store sweeps out expired keys
+const pruneInterval = time.Minute
+
+// IdempotencyStore remembers the task that was published under each key. A
+// key is reserved before its task is published, so only one request publishes
+// it. Keys are prefixed with the queue name. A store forgets keys once they're
+// older than the idempotency window, and lets a reservation that has been held
+// for more than 30 seconds be taken over, in case whoever held it died.
+type IdempotencyStore interface {
+	// Get is the task published under the key, if it has been
+	Get(ctx context.Context, key string) (kewpie.Task, bool, error)
+	// Reserve claims the key, unless someone else already has
+	Reserve(ctx context.Context, key string) (bool, error)
+	// Put records the task published under a reserved key
+	Put(ctx context.Context, key string, task kewpie.Task) error
+	// Release gives up a key whose task wasn't published
+	Release(ctx context.Context, key string) error
+}
+
+// publish publishes the task unless a task has already been published with the
+// same key, in which case the original is handed back instead. It reports
+// whether the task was replayed.
+func (s *server) publish(ctx context.Context, queueName string, pending *pendingTask) (bool, error) {
+	replayed, err := s.reserve(ctx, queueName, pending)
+	if err != nil || replayed {
+		return replayed, err
+	}
+
+	if err := s.queue.Publish(ctx, queueName, &pending.Task); err != nil {
+		s.release(ctx, queueName, *pending)
+		return false, err
+	}
+
+	s.remember(ctx, queueName, *pending)
+	return false, nil
+}
+
+// reserve reserves the task's key so it can be published, or swaps in the
+// task originally published under it. While another request holds the key, it
+// waits to see how that one turns out.
+func (s *server) reserve(ctx context.Context, queueName string, pending *pendingTask) (bool, error) {
+	if pending.IdempotencyKey == "" {
+		return false, nil
+	}
+
+	key := queueName + "/" + pending.IdempotencyKey
+	for {
+		original, ok, err := s.idempotency.Get(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			pending.Task = original
+			return true, nil
+		}
+
+		reserved, err := s.idempotency.Reserve(ctx, key)
+		if err != nil || reserved {
+			return false, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(reservationPoll):
+		}
+	}
+}
+
+// release gives up the key of a task that wasn't published, so a retry can
+// publish it
+func (s *server) release(ctx context.Context, queueName string, pending pendingTask) {
+	if pending.IdempotencyKey == "" {
+		return
+	}
+
+	key := queueName + "/" + pending.IdempotencyKey
+	if err := s.idempotency.Release(ctx, key); err != nil {
+		log.Println("WARN failed to release idempotency key", key, err)
+	}
+}
+
+// remember records a published task under its key, if it has one
+func (s *server) remember(ctx context.Context, queueName string, pending pendingTask) {
+	if pending.IdempotencyKey == "" {
+		return
+	}
+
+	key := queueName + "/" + pending.IdempotencyKey
+	if err := s.idempotency.Put(ctx, key, pending.Task); err != nil {
+		log.Println("WARN failed to record idempotency key", key, err)
+	}
+}
+
+// applyIdempotencyKey gives each task without a key of its own one derived
+// from the Idempotency-Key header, if there is one
+func applyIdempotencyKey(r *http.Request, pending []pendingTask) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return
+	}
+	for i := range pending {
+		if pending[i].IdempotencyKey != "" {
+			continue
+		}
+		if len(pending) == 1 {
+			pending[i].IdempotencyKey = key
+		} else {
+			pending[i].IdempotencyKey = key + "/" + strconv.Itoa(i)
+		}
+	}
+}
+
+type idempotencyRecord struct {
+	task kewpie.Task
+	// published is false while the key is only reserved
+	published bool
+	created   time.Time
+	expires   time.Time
+}
+
+type memoryIdempotencyStore struct {
+	sync.Mutex
+	window  time.Duration
+	records map[string]idempotencyRecord
+	// pruned is when expired keys were last swept out
+	pruned time.Time
+}
+
+func newMemoryIdempotencyStore(window time.Duration) *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		window:  window,
+		records: map[string]idempotencyRecord{},
+		pruned:  time.Now(),
+	}
+}
+
+// prune sweeps out expired keys, at most once every pruneInterval. Expired
+// keys are ignored until then, so the sweep is only to free up the memory.
+// It must be called with the lock held.
+func (store *memoryIdempotencyStore) prune(now time.Time) {
+	if now.Before(store.pruned.Add(pruneInterval)) {
+		return
+	}
+	for k, record := range store.records {
+		if now.After(record.expires) {
+			delete(store.records, k)
+		}
+	}
+	store.pruned = now
+}
+
+func (store *memoryIdempotencyStore) Get(ctx context.Context, key string) (kewpie.Task, bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	record, ok := store.records[key]
+	if !ok || !record.published || time.Now().After(record.expires) {
+		return kewpie.Task{}, false, nil
+	}
+	return record.task, true, nil
+}
+
+func (store *memoryIdempotencyStore) Reserve(ctx context.Context, key string) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now()
+	store.prune(now)
+
+	if record, ok := store.records[key]; ok && !now.After(record.expires) {
+		if record.published || now.Before(record.created.Add(reservationTimeout)) {
+			return false, nil
+		}
+	}
+
+	store.records[key] = idempotencyRecord{
+		created: now,
+		expires: now.Add(store.window),
+	}
+	return true, nil
+}
+
+func (store *memoryIdempotencyStore) Put(ctx context.Context, key string, task kewpie.Task) error {
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now()
+	store.records[key] = idempotencyRecord{
+		task:      task,
+		published: true,
+		created:   now,
+		expires:   now.Add(store.window),
+	}
+	return nil
+}
+
+func (store *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if record, ok := store.records[key]; ok && !record.published {
+		delete(store.records, key)
+	}
+	return nil
+}
+
+type postgresIdempotencyStore struct {
+	db     *sql.DB
+	window time.Duration
+}
+
+func (store postgresIdempotencyStore) Get(ctx context.Context, key string) (kewpie.Task, bool, error) {
+	task := kewpie.Task{}
+	raw := []byte{}
+	err := store.db.QueryRowContext(ctx, `SELECT task FROM kewpie_http_idempotency WHERE key = $1 AND created_at > $2 AND task != 'null'`,
+		key,
+		time.Now().Add(-store.window),
+	).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return task, false, nil
+	}
+	if err != nil {
+		return task, false, err
+	}
+	if err := json.Unmarshal(raw, &task); err != nil {
+		return task, false, err
+	}
+	return task, true, nil
+}
+
+// Reserve inserts a record with a null task. Only one request can insert it,
+// or take over one that has expired or was reserved too long ago.
+func (store postgresIdempotencyStore) Reserve(ctx context.Context, key string) (bool, error) {
+	if _, err := store.db.ExecContext(ctx, `DELETE FROM kewpie_http_idempotency WHERE created_at < $1`, time.Now().Add(-store.window)); err != nil {
+		return false, err
+	}
+
+	res, err := store.db.ExecContext(ctx, `INSERT INTO kewpie_http_idempotency (key, task) VALUES ($1, 'null')
+ON CONFLICT (key) DO UPDATE SET task = 'null', created_at = NOW()
+WHERE kewpie_http_idempotency.created_at < $2
+OR (kewpie_http_idempotency.task = 'null' AND kewpie_http_idempotency.created_at < $3)`,
+		key,
+		time.Now().Add(-store.window),
+		time.Now().Add(-reservationTimeout),
+	)
+	if err != nil {
+		return false, err
+	}
+	reserved, err := res.RowsAffected()
+	return reserved == 1, err
+}
+
+func (store postgresIdempotencyStore) Put(ctx context.Context, key string, task kewpie.Task) error {
+	raw, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.db.ExecContext(ctx, `UPDATE kewpie_http_idempotency SET task = $2, created_at = NOW() WHERE key = $1`, key, raw)
+	return err
+}
+
+func (store postgresIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := store.db.ExecContext(ctx, `DELETE FROM kewpie_http_idempotency WHERE key = $1 AND task = 'null'`, key)
+	return err
+}
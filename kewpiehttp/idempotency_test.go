@@ -0,0 +1,263 @@
+package kewpiehttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "idempotencytest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestPublishIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	key := uuid.NewV4().String()
+
+	payload, err := json.Marshal(kewpie.Task{
+		Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+	})
+	assert.Nil(t, err)
+
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/queues/idempotencytest", bytes.NewReader(payload))
+		assert.Nil(t, err)
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		res := kewpie.Task{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		ids = append(ids, res.ID)
+
+		if i > 0 {
+			assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+		}
+	}
+
+	assert.Equal(t, ids[0], ids[1])
+
+	subreq, err := http.NewRequest("GET", "/queues/idempotencytest/pop-many?max=5&wait=5s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+
+	assert.Equal(t, http.StatusOK, subrr.Code)
+	subbed := []kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(subrr.Body.Bytes(), &subbed))
+	assert.Equal(t, 1, len(subbed))
+}
+
+func TestPublishManyIdempotencyKeys(t *testing.T) {
+	t.Parallel()
+
+	key := uuid.NewV4().String()
+
+	payload, err := json.Marshal([]pendingTask{
+		pendingTask{
+			Task: kewpie.Task{
+				Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+			},
+			IdempotencyKey: uuid.NewV4().String(),
+		},
+		pendingTask{
+			Task: kewpie.Task{
+				Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	results := [][]kewpie.Task{}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/queues/test/publish-many", bytes.NewReader(payload))
+		assert.Nil(t, err)
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		res := []kewpie.Task{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		results = append(results, res)
+	}
+
+	assert.Equal(t, 2, len(results[1]))
+	assert.Equal(t, results[0][0].ID, results[1][0].ID)
+	assert.Equal(t, results[0][1].ID, results[1][1].ID)
+	assert.NotEqual(t, results[1][0].ID, results[1][1].ID)
+}
+
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryIdempotencyStore(50 * time.Millisecond)
+
+	assert.Nil(t, store.Put(ctx, "foo", kewpie.Task{ID: "bar"}))
+
+	task, ok, err := store.Get(ctx, "foo")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "bar", task.ID)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, ok, err = store.Get(ctx, "foo")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// An expired key can be used again before it has been swept out
+	reserved, err := store.Reserve(ctx, "foo")
+	assert.Nil(t, err)
+	assert.True(t, reserved)
+
+	// Keys that are never used again are swept out once in a while
+	assert.Nil(t, store.Put(ctx, "forgotten", kewpie.Task{ID: "baz"}))
+	time.Sleep(100 * time.Millisecond)
+	store.pruned = time.Now().Add(-pruneInterval)
+	_, err = store.Reserve(ctx, "other")
+	assert.Nil(t, err)
+	_, ok = store.records["forgotten"]
+	assert.False(t, ok)
+}
+
+func TestConcurrentPublishIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	s := memoryServer(t, map[string]config.QueueSettings{
+		"concurrentkey": {},
+	})
+	key := uuid.NewV4().String()
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	ids := make([]string, 10)
+	replays := 0
+	var replaysLock sync.Mutex
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, err := http.NewRequest("POST", "/queues/concurrentkey", strings.NewReader(`{"body": "once"}`))
+			assert.Nil(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", key)
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+
+			codes[i] = rr.Code
+			res := kewpie.Task{}
+			assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+			ids[i] = res.ID
+			if rr.Header().Get("Idempotent-Replayed") == "true" {
+				replaysLock.Lock()
+				replays++
+				replaysLock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range codes {
+		assert.Equal(t, http.StatusCreated, codes[i])
+		assert.Equal(t, ids[0], ids[i])
+	}
+	assert.Equal(t, len(codes)-1, replays)
+
+	req, err := http.NewRequest("GET", "/queues/concurrentkey/pop-many?max=20&wait=1500ms", nil)
+	assert.Nil(t, err)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	popped := []kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &popped))
+	assert.Equal(t, 1, len(popped))
+}
+
+func TestMemoryIdempotencyReservation(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryIdempotencyStore(time.Hour)
+
+	reserved, err := store.Reserve(ctx, "k")
+	assert.Nil(t, err)
+	assert.True(t, reserved)
+
+	// Someone else can't have it while it's held
+	reserved, err = store.Reserve(ctx, "k")
+	assert.Nil(t, err)
+	assert.False(t, reserved)
+	_, ok, err := store.Get(ctx, "k")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Nor once its task is published
+	assert.Nil(t, store.Put(ctx, "k", kewpie.Task{ID: "published"}))
+	reserved, err = store.Reserve(ctx, "k")
+	assert.Nil(t, err)
+	assert.False(t, reserved)
+	task, ok, err := store.Get(ctx, "k")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "published", task.ID)
+
+	// A key whose publish failed is given up for a retry
+	reserved, err = store.Reserve(ctx, "failed")
+	assert.Nil(t, err)
+	assert.True(t, reserved)
+	assert.Nil(t, store.Release(ctx, "failed"))
+	reserved, err = store.Reserve(ctx, "failed")
+	assert.Nil(t, err)
+	assert.True(t, reserved)
+}
+
+func TestWithIdempotencyStore(t *testing.T) {
+	t.Parallel()
+
+	store := newMemoryIdempotencyStore(time.Hour)
+	q := &kewpie.Kewpie{}
+	assert.Nil(t, q.Connect("memory", []string{"storetest"}))
+	s := New(q,
+		WithBackend("memory"),
+		WithQueue("storetest", config.QueueSettings{}),
+		WithIdempotencyStore(store),
+	)
+
+	req, err := http.NewRequest("POST", "/queues/storetest", strings.NewReader(`{"body": "stored"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "mine")
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	res := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	task, ok, err := store.Get(context.Background(), "storetest/mine")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, res.ID, task.ID)
+}
@@ -0,0 +1,170 @@
+// Package kewpiehttp serves Kewpie queues over HTTP. New builds an
+// http.Handler, so the API can be mounted under a sub-path of another
+// service and wrapped in its middleware:
+//
+//	q := &kewpie.Kewpie{}
+//	q.Connect("postgres", []string{"emails"})
+//	mux.Handle("/kewpie/", http.StripPrefix("/kewpie", kewpiehttp.New(q,
+//		kewpiehttp.WithBackend("postgres"),
+//		kewpiehttp.WithQueue("emails", config.QueueSettings{}),
+//	)))
+package kewpiehttp
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/davidbanham/kewpie_go/types"
+	"github.com/paidright/kewpie_http/config"
+)
+
+// Queue is a connection to a queue backend. *kewpie.Kewpie is one, once it's
+// connected to the queues being served.
+type Queue interface {
+	Publish(ctx context.Context, queueName string, payload *kewpie.Task) error
+	Pop(ctx context.Context, queueName string, handler types.Handler) error
+	Subscribe(ctx context.Context, queueName string, handler types.Handler) error
+	Purge(ctx context.Context, queueName string) error
+	PurgeMatching(ctx context.Context, queueName, substr string) error
+	Healthy(ctx context.Context) error
+}
+
+// disconnecter is a Queue that can be closed when it's no longer needed
+type disconnecter interface {
+	Disconnect() error
+}
+
+// defaultIdempotencyWindow is how long idempotency keys are remembered when
+// the config doesn't say
+const defaultIdempotencyWindow = 24 * time.Hour
+
+type options struct {
+	conf        config.Config
+	ctx         context.Context
+	reload      bool
+	db          *sql.DB
+	idempotency IdempotencyStore
+	version     string
+}
+
+// Option changes how the handler built by New behaves
+type Option func(*options)
+
+// WithConfig serves the queues, keys and settings in conf. Options after it
+// change it further, without changing conf.
+func WithConfig(conf config.Config) Option {
+	return func(o *options) {
+		o.conf = conf
+		o.conf.APIKeys = map[string]string{}
+		for name, key := range conf.APIKeys {
+			o.conf.APIKeys[name] = key
+		}
+		o.conf.Queues = map[string]config.QueueSettings{}
+		for name, settings := range conf.Queues {
+			o.conf.Queues[name] = settings
+		}
+	}
+}
+
+// WithBackend is the kind of backend the Queue passed to New is, eg:
+// postgres. Queues registered at runtime are kept in the same kind.
+func WithBackend(backend string) Option {
+	return func(o *options) {
+		o.conf.Backend = backend
+	}
+}
+
+// WithQueue serves the named queue
+func WithQueue(name string, settings config.QueueSettings) Option {
+	return func(o *options) {
+		if o.conf.Queues == nil {
+			o.conf.Queues = map[string]config.QueueSettings{}
+		}
+		o.conf.Queues[name] = settings
+	}
+}
+
+// WithAdminToken enables the admin endpoints, guarded by token
+func WithAdminToken(token string) Option {
+	return func(o *options) {
+		o.conf.AdminToken = token
+	}
+}
+
+// WithAPIKey adds a named API key
+func WithAPIKey(name, key string) Option {
+	return func(o *options) {
+		if o.conf.APIKeys == nil {
+			o.conf.APIKeys = map[string]string{}
+		}
+		o.conf.APIKeys[name] = key
+	}
+}
+
+// WithContext stops background work, like webhook delivery, when ctx is done
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithReload reloads the config on SIGHUP and when the config file changes.
+// Reloading reads the config from the environment, so only use it with a
+// config that came from config.Load.
+func WithReload() Option {
+	return func(o *options) {
+		o.reload = true
+	}
+}
+
+// WithDB is the database behind the postgres backend, for the things the
+// kewpie library doesn't do itself. Without it, one is connected to from
+// DB_URI if any queues are kept in postgres.
+func WithDB(db *sql.DB) Option {
+	return func(o *options) {
+		o.db = db
+	}
+}
+
+// WithIdempotencyStore keeps idempotency keys in store. Without it, they're
+// kept in postgres if any queues are, and in memory otherwise.
+func WithIdempotencyStore(store IdempotencyStore) Option {
+	return func(o *options) {
+		o.idempotency = store
+	}
+}
+
+// WithVersion is the version reported by the health check
+func WithVersion(version string) Option {
+	return func(o *options) {
+		o.version = version
+	}
+}
+
+// New serves the configured queues over HTTP. Queues kept in the config's
+// backend use q, and queues that name another backend get their own
+// connection. Routes are relative to wherever the handler is mounted.
+func New(q Queue, opts ...Option) http.Handler {
+	o := options{
+		ctx: context.Background(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.conf.IdempotencyWindow <= 0 {
+		o.conf.IdempotencyWindow = defaultIdempotencyWindow
+	}
+	if o.conf.APIKeys == nil {
+		o.conf.APIKeys = map[string]string{}
+	}
+	if o.conf.Queues == nil {
+		o.conf.Queues = map[string]config.QueueSettings{}
+	}
+
+	s := newServer(q, o)
+	s.start()
+	return s
+}
@@ -0,0 +1,330 @@
+package kewpiehttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	uuid "github.com/satori/go.uuid"
+)
+
+var errLeaseExpired = errors.New("Lease expired before the task was acked")
+var errNacked = errors.New("Task was nacked by the client")
+
+// claim pops a single task from the named queue and returns it once it has
+// been handed over. settle is then called from within the kewpie handler, and
+// its return value decides whether the backend completes or requeues the task.
+// If ctx is done or the queue is paused before a task has been handed over,
+// nothing is consumed.
+func (s *server) claim(ctx context.Context, queueName string, settle func(kewpie.Task) (bool, error)) (kewpie.Task, error) {
+	// The pop gets its own context so that the backend can still requeue the
+	// task after the request that claimed it has finished. It's only cancelled
+	// if nothing has been taken yet.
+	popCtx, cancel := context.WithCancel(context.Background())
+	waiting, stopWaiting := s.state.untilPaused(ctx, queueName)
+	defer stopWaiting()
+
+	var mu sync.Mutex
+	taken := false
+	go func() {
+		<-waiting.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		if !taken {
+			cancel()
+		}
+	}()
+
+	claimed := make(chan kewpie.Task)
+	errs := make(chan error, 1)
+
+	handler := yoloHandler{
+		handleFunc: func(task kewpie.Task) (bool, error) {
+			mu.Lock()
+			if waiting.Err() != nil {
+				// The pop took this one just as we stopped waiting for it
+				mu.Unlock()
+				return s.putBack(queueName, task)
+			}
+			taken = true
+			mu.Unlock()
+
+			select {
+			case claimed <- task:
+				return settle(task)
+			case <-waiting.Done():
+				// Nobody is waiting for it any more, so put it straight back
+				return s.putBack(queueName, task)
+			}
+		},
+	}
+
+	go func() {
+		defer cancel()
+		errs <- s.queue.Pop(popCtx, queueName, handler)
+	}()
+
+	select {
+	case task := <-claimed:
+		return task, nil
+	case err := <-errs:
+		if waiting.Err() == nil && err != nil {
+			return kewpie.Task{}, err
+		}
+	case <-waiting.Done():
+	}
+
+	if ctx.Err() != nil {
+		return kewpie.Task{}, ctx.Err()
+	}
+	return kewpie.Task{}, errQueuePaused
+}
+
+// putBack returns a popped task to the queue as it was, without counting an
+// attempt. If it can't, the backend is left to requeue it, so it isn't lost.
+func (s *server) putBack(queueName string, task kewpie.Task) (bool, error) {
+	task.Delay = 0
+	task.RunAt = time.Now()
+	if err := s.queue.Publish(context.Background(), queueName, &task); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+type leaseResult struct {
+	requeue bool
+	err     error
+}
+
+type lease struct {
+	Token    string
+	Queue    string
+	Task     kewpie.Task
+	Expires  time.Time
+	duration time.Duration
+	ready    chan struct{}
+	done     chan leaseResult
+	// server is what the lease was taken out on
+	server *server
+}
+
+func (s *server) newLease(queueName string, duration time.Duration) *lease {
+	return &lease{
+		server:   s,
+		Token:    uuid.NewV4().String(),
+		Queue:    queueName,
+		duration: duration,
+		ready:    make(chan struct{}),
+		done:     make(chan leaseResult, 1),
+	}
+}
+
+// hold registers the lease and then blocks the kewpie handler until the lease
+// is acked, nacked or expires
+func (l *lease) hold(task kewpie.Task) (bool, error) {
+	l.server.leases.add(l, task)
+	close(l.ready)
+
+	timer := time.NewTimer(l.duration)
+	defer timer.Stop()
+
+	for {
+		select {
+		case res := <-l.done:
+			return l.result(res)
+		case <-timer.C:
+			left, ok := l.server.leases.expire(l)
+			if !ok {
+				// It was settled just as the timer fired
+				return l.result(<-l.done)
+			}
+			if left <= 0 {
+				return l.server.failed(l.Queue, task, errLeaseExpired)
+			}
+			// It has been extended, so wait out the rest of it
+			timer.Reset(left)
+		}
+	}
+}
+
+func (l *lease) result(res leaseResult) (bool, error) {
+	if res.requeue {
+		return l.server.failed(l.Queue, l.Task, res.err)
+	}
+	return false, res.err
+}
+
+type leaseRegistry struct {
+	sync.Mutex
+	active map[string]*lease
+}
+
+func newLeaseRegistry() *leaseRegistry {
+	return &leaseRegistry{
+		active: map[string]*lease{},
+	}
+}
+
+func (reg *leaseRegistry) add(l *lease, task kewpie.Task) {
+	reg.Lock()
+	defer reg.Unlock()
+	l.Task = task
+	l.Expires = time.Now().Add(l.duration)
+	reg.active[l.Queue+"/"+task.ID] = l
+}
+
+func (reg *leaseRegistry) remove(l *lease) bool {
+	reg.Lock()
+	defer reg.Unlock()
+	key := l.Queue + "/" + l.Task.ID
+	if reg.active[key] != l {
+		return false
+	}
+	delete(reg.active, key)
+	return true
+}
+
+// expire removes the lease if it has run out and reports how long it has left.
+// It reports false if the lease is no longer active.
+func (reg *leaseRegistry) expire(l *lease) (time.Duration, bool) {
+	reg.Lock()
+	defer reg.Unlock()
+	key := l.Queue + "/" + l.Task.ID
+	if reg.active[key] != l {
+		return 0, false
+	}
+	left := time.Until(l.Expires)
+	if left <= 0 {
+		delete(reg.active, key)
+	}
+	return left, true
+}
+
+// extend pushes the expiry of an active lease out to duration from now
+func (reg *leaseRegistry) extend(l *lease, duration time.Duration) (time.Time, bool) {
+	reg.Lock()
+	defer reg.Unlock()
+	if reg.active[l.Queue+"/"+l.Task.ID] != l {
+		return time.Time{}, false
+	}
+	l.Expires = time.Now().Add(duration)
+	return l.Expires, true
+}
+
+// expires is when an active lease runs out. extend can change it at any time,
+// so it's read under the lock.
+func (reg *leaseRegistry) expires(l *lease) time.Time {
+	reg.Lock()
+	defer reg.Unlock()
+	return l.Expires
+}
+
+func (reg *leaseRegistry) get(queueName, id string) *lease {
+	reg.Lock()
+	defer reg.Unlock()
+	return reg.active[queueName+"/"+id]
+}
+
+// count is how many tasks from the named queue are leased out
+func (reg *leaseRegistry) count(queueName string) int {
+	reg.Lock()
+	defer reg.Unlock()
+	count := 0
+	for _, l := range reg.active {
+		if l.Queue == queueName {
+			count++
+		}
+	}
+	return count
+}
+
+// settle ends the lease on the identified task and hands the result back to
+// the kewpie handler holding it
+func (reg *leaseRegistry) settle(l *lease, res leaseResult) bool {
+	if !reg.remove(l) {
+		return false
+	}
+	l.done <- res
+	return true
+}
+
+func sendLease(w http.ResponseWriter, r *http.Request, l *lease, expires time.Time) {
+	w.Header().Set("Lease-Token", l.Token)
+	w.Header().Set("Lease-Expires", expires.Format(time.RFC3339))
+	sendPayloadMeta(w, r, l.Task, map[string]string{
+		"lease_token":   l.Token,
+		"lease_expires": expires.Format(time.RFC3339),
+	})
+}
+
+// leaseHandler acks, nacks or extends a leased task, depending on action
+func (s *server) leaseHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.settleLease(w, r, action)
+	}
+}
+
+func (s *server) settleLease(w http.ResponseWriter, r *http.Request, action string) {
+	queueName := queueName(r)
+	id := pathParam(r, "id")
+
+	token := r.Header.Get("Lease-Token")
+	if token == "" {
+		token = r.URL.Query().Get("lease_token")
+	}
+	if token == "" {
+		errRes(w, r, http.StatusBadRequest, "A lease token is required, either as a Lease-Token header or a lease_token parameter", nil)
+		return
+	}
+
+	l := s.leases.get(queueName, id)
+	if l == nil {
+		errRes(w, r, http.StatusNotFound, "No active lease for that task. It may have expired", nil)
+		return
+	}
+	if l.Token != token {
+		errRes(w, r, http.StatusConflict, "Lease token does not match the active lease on that task", nil)
+		return
+	}
+
+	if action == "extend" {
+		duration, err := leaseFor(r)
+		if err != nil || duration == 0 {
+			errRes(w, r, http.StatusBadRequest, "Lease is not a valid duration, eg: 30s", err)
+			return
+		}
+		expires, ok := s.leases.extend(l, duration)
+		if !ok {
+			errRes(w, r, http.StatusNotFound, "No active lease for that task. It may have expired", nil)
+			return
+		}
+		sendLease(w, r, l, expires)
+		return
+	}
+
+	res := leaseResult{}
+	if action == "nack" {
+		res = nack(r.URL.Query().Get("reason"))
+	}
+
+	if !s.leases.settle(l, res) {
+		errRes(w, r, http.StatusNotFound, "No active lease for that task. It may have expired", nil)
+		return
+	}
+
+	sendPayload(w, r, l.Task)
+}
+
+func nack(reason string) leaseResult {
+	res := leaseResult{
+		requeue: true,
+		err:     errNacked,
+	}
+	if reason != "" {
+		res.err = errors.New(reason)
+	}
+	return res
+}
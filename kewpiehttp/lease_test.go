@@ -0,0 +1,245 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	for _, name := range []string{"leasetest", "nacktest", "expirytest"} {
+		if err := testServer.queue.Purge(context.Background(), name); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func TestLeaseAck(t *testing.T) {
+	t.Parallel()
+
+	fixture := kewpie.Task{
+		Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "leasetest", &fixture))
+
+	subreq, err := http.NewRequest("GET", "/queues/leasetest?lease=30s", nil)
+	assert.Nil(t, err)
+	subreq.Header.Set("Accept", "application/vnd.api+json")
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+
+	assert.Equal(t, http.StatusOK, subrr.Code)
+
+	res := jsonAPIPayload{}
+	assert.Nil(t, json.Unmarshal(subrr.Body.Bytes(), &res))
+	assert.Equal(t, fixture.Body, res.Data.Attributes.Body)
+	assert.NotEmpty(t, res.Meta["lease_token"])
+	assert.Equal(t, res.Meta["lease_token"], subrr.Header().Get("Lease-Token"))
+
+	wrongreq, err := http.NewRequest("POST", "/queues/leasetest/tasks/"+res.Data.ID+"/ack?lease_token="+uuid.NewV4().String(), nil)
+	assert.Nil(t, err)
+
+	wrongrr := httptest.NewRecorder()
+	Router()(wrongrr, wrongreq)
+
+	assert.Equal(t, http.StatusConflict, wrongrr.Code)
+
+	ackreq, err := http.NewRequest("POST", "/queues/leasetest/tasks/"+res.Data.ID+"/ack", nil)
+	assert.Nil(t, err)
+	ackreq.Header.Set("Lease-Token", res.Meta["lease_token"])
+
+	ackrr := httptest.NewRecorder()
+	Router()(ackrr, ackreq)
+
+	assert.Equal(t, http.StatusOK, ackrr.Code)
+
+	againrr := httptest.NewRecorder()
+	Router()(againrr, ackreq)
+
+	assert.Equal(t, http.StatusNotFound, againrr.Code)
+}
+
+func TestLeaseNack(t *testing.T) {
+	t.Parallel()
+
+	fixture := kewpie.Task{
+		Body:         `{"hi": "` + uuid.NewV4().String() + `"}`,
+		NoExpBackoff: true,
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "nacktest", &fixture))
+
+	subreq, err := http.NewRequest("GET", "/queues/nacktest?lease=30s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+
+	assert.Equal(t, http.StatusOK, subrr.Code)
+
+	subbed := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(subrr.Body.Bytes(), &subbed))
+
+	nackreq, err := http.NewRequest("POST", "/queues/nacktest/tasks/"+subbed.ID+"/nack?reason=nope", nil)
+	assert.Nil(t, err)
+	nackreq.Header.Set("Lease-Token", subrr.Header().Get("Lease-Token"))
+
+	nackrr := httptest.NewRecorder()
+	Router()(nackrr, nackreq)
+
+	assert.Equal(t, http.StatusOK, nackrr.Code)
+
+	resubrr := httptest.NewRecorder()
+	Router()(resubrr, subreq)
+
+	assert.Equal(t, http.StatusOK, resubrr.Code)
+
+	resubbed := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(resubrr.Body.Bytes(), &resubbed))
+	assert.Equal(t, fixture.Body, resubbed.Body)
+	assert.Equal(t, 1, resubbed.Attempts)
+}
+
+func TestLeaseExtend(t *testing.T) {
+	s := memoryServer(t, map[string]config.QueueSettings{
+		"extendtest": config.QueueSettings{},
+	})
+
+	fixture := kewpie.Task{
+		Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+	}
+	assert.Nil(t, s.queue.Publish(context.Background(), "extendtest", &fixture))
+
+	subreq, err := http.NewRequest("GET", "/queues/extendtest?lease=30s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	s.ServeHTTP(subrr, subreq)
+	assert.Equal(t, http.StatusOK, subrr.Code)
+	token := subrr.Header().Get("Lease-Token")
+
+	// Reading the lease while it's extended mustn't race
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("POST", "/queues/extendtest/tasks/"+fixture.ID+"/extend?lease=1h", nil)
+			assert.Nil(t, err)
+			req.Header.Set("Lease-Token", token)
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+		}()
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "/queues/extendtest/tasks/"+fixture.ID, nil)
+			assert.Nil(t, err)
+
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+		}()
+	}
+	wg.Wait()
+
+	extendreq, err := http.NewRequest("POST", "/queues/extendtest/tasks/"+fixture.ID+"/extend?lease=1h", nil)
+	assert.Nil(t, err)
+	extendreq.Header.Set("Lease-Token", token)
+
+	extendrr := httptest.NewRecorder()
+	s.ServeHTTP(extendrr, extendreq)
+	assert.Equal(t, http.StatusOK, extendrr.Code)
+	expires, err := time.Parse(time.RFC3339, extendrr.Header().Get("Lease-Expires"))
+	assert.Nil(t, err)
+	assert.True(t, expires.After(time.Now().Add(59*time.Minute)))
+
+	ackreq, err := http.NewRequest("POST", "/queues/extendtest/tasks/"+fixture.ID+"/ack", nil)
+	assert.Nil(t, err)
+	ackreq.Header.Set("Lease-Token", token)
+
+	ackrr := httptest.NewRecorder()
+	s.ServeHTTP(ackrr, ackreq)
+	assert.Equal(t, http.StatusOK, ackrr.Code)
+}
+
+func TestClaimAfterClientHasGone(t *testing.T) {
+	s := memoryServer(t, map[string]config.QueueSettings{
+		"gonetest": config.QueueSettings{},
+	})
+
+	fixture := kewpie.Task{
+		Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+	}
+	assert.Nil(t, s.queue.Publish(context.Background(), "gonetest", &fixture))
+
+	// Each of these may or may not pop the task before noticing the client has
+	// gone. Either way it stays on the queue without using up an attempt.
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := s.claim(ctx, "gonetest", func(kewpie.Task) (bool, error) {
+			return false, nil
+		})
+		assert.Equal(t, context.Canceled, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	task, err := s.claim(ctx, "gonetest", func(kewpie.Task) (bool, error) {
+		return false, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, fixture.Body, task.Body)
+	assert.Equal(t, 0, task.Attempts)
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	t.Parallel()
+
+	fixture := kewpie.Task{
+		Body:         `{"hi": "` + uuid.NewV4().String() + `"}`,
+		NoExpBackoff: true,
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "expirytest", &fixture))
+
+	subreq, err := http.NewRequest("GET", "/queues/expirytest?lease=1s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+
+	assert.Equal(t, http.StatusOK, subrr.Code)
+
+	time.Sleep(2 * time.Second)
+
+	resubrr := httptest.NewRecorder()
+	Router()(resubrr, subreq)
+
+	assert.Equal(t, http.StatusOK, resubrr.Code)
+
+	resubbed := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(resubrr.Body.Bytes(), &resubbed))
+	assert.Equal(t, fixture.Body, resubbed.Body)
+}
+
+func TestLeaseInvalidDuration(t *testing.T) {
+	subreq, err := http.NewRequest("GET", "/queues/leasetest?lease=forever", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+
+	assert.Equal(t, http.StatusBadRequest, subrr.Code)
+}
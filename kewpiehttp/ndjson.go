@@ -0,0 +1,130 @@
+package kewpiehttp
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxNDJSONLine is the longest single task accepted in an NDJSON stream
+const maxNDJSONLine = 10 * 1024 * 1024
+
+// maxNDJSONErrors caps how many line errors are reported, so that a file full
+// of garbage doesn't produce a summary as big as itself
+const maxNDJSONErrors = 1000
+
+type ndjsonError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type ndjsonSummary struct {
+	Received        int           `json:"received"`
+	Published       int           `json:"published"`
+	Replayed        int           `json:"replayed"`
+	Failed          int           `json:"failed"`
+	Errors          []ndjsonError `json:"errors"`
+	ErrorsTruncated bool          `json:"errors_truncated,omitempty"`
+}
+
+func (summary *ndjsonSummary) fail(line int, err error) {
+	summary.Failed++
+	if len(summary.Errors) >= maxNDJSONErrors {
+		summary.ErrorsTruncated = true
+		return
+	}
+	summary.Errors = append(summary.Errors, ndjsonError{
+		Line:  line,
+		Error: err.Error(),
+	})
+}
+
+type jsonAPISummaryPayload struct {
+	Errors []map[string]string `json:"errors"`
+	Meta   ndjsonSummary       `json:"meta"`
+}
+
+// publishNDJSON publishes a stream of newline delimited JSON tasks as they are
+// read, rather than holding the whole batch in memory
+func (s *server) publishNDJSON(w http.ResponseWriter, r *http.Request, queueName string) {
+	if r.URL.Query().Get("atomic") == "true" {
+		errRes(w, r, http.StatusBadRequest, "Atomic publishing isn't supported for NDJSON, as tasks are published as they are read", nil)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+
+	summary := ndjsonSummary{
+		Errors: []ndjsonError{},
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxNDJSONLine)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		summary.Received++
+
+		pending := pendingTask{}
+		if err := json.Unmarshal([]byte(raw), &pending); err != nil {
+			summary.fail(line, err)
+			continue
+		}
+		if pending.IdempotencyKey == "" && key != "" {
+			pending.IdempotencyKey = key + "/" + strconv.Itoa(line)
+		}
+		if err := s.validateTask(queueName, pending.Task); err != nil {
+			summary.fail(line, err)
+			continue
+		}
+
+		replayed, err := s.publish(r.Context(), queueName, &pending)
+		if err != nil {
+			summary.fail(line, err)
+			continue
+		}
+		if replayed {
+			summary.Replayed++
+			continue
+		}
+		summary.Published++
+	}
+	if err := scanner.Err(); err != nil {
+		summary.fail(line+1, err)
+	}
+
+	status := http.StatusCreated
+	if summary.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		payload := jsonAPISummaryPayload{
+			Meta: summary,
+		}
+		for _, e := range summary.Errors {
+			payload.Errors = append(payload.Errors, map[string]string{
+				"detail": "Line " + strconv.Itoa(e.Line) + ": " + e.Error,
+			})
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+	}
+}
@@ -0,0 +1,67 @@
+package kewpiehttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishManyNDJSON(t *testing.T) {
+	t.Parallel()
+
+	lines := []string{
+		`{"body": "{\"hi\": \"` + uuid.NewV4().String() + `\"}"}`,
+		`{"body": "lolwut", "no_exp_backoff": true}`,
+		``,
+		`{"request_id": "user-001", "title": "Extra fields are ignored", "body": "Still a task"}`,
+		`{"body": "missing a brace"`,
+		`{"body": "from the past", "delay": -60000000000}`,
+	}
+
+	req, err := http.NewRequest("POST", "/queues/test/publish-many", strings.NewReader(strings.Join(lines, "\n")))
+	assert.Nil(t, err)
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusMultiStatus, rr.Code)
+	res := ndjsonSummary{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, 5, res.Received)
+	assert.Equal(t, 3, res.Published)
+	assert.Equal(t, 2, res.Failed)
+	assert.Equal(t, 5, res.Errors[0].Line)
+	assert.Equal(t, 6, res.Errors[1].Line)
+}
+
+func TestPublishManyNDJSONIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	body := `{"body": "one"}` + "\n" + `{"body": "two"}` + "\n"
+	key := uuid.NewV4().String()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/queues/test/publish-many", strings.NewReader(body))
+		assert.Nil(t, err)
+
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Idempotency-Key", key)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		res := ndjsonSummary{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		assert.Equal(t, 2, res.Received)
+		assert.Equal(t, 2, res.Published+res.Replayed)
+		assert.Equal(t, 2*i, res.Replayed)
+	}
+}
@@ -0,0 +1,41 @@
+package kewpiehttp
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errQueuePaused = errors.New("Queue is paused. Tasks can still be published to it, but none will be handed out until it is resumed")
+
+// unlessPaused turns consumers away from paused queues
+func (s *server) unlessPaused(handler http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.state.paused(queueName(r)) {
+			errRes(w, r, http.StatusLocked, errQueuePaused.Error(), nil)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	if err := s.state.pause(queueName); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error pausing queue", err)
+		return
+	}
+
+	sendQueue(w, r, s.visibleTo(r, s.describeQueue(queueName)))
+}
+
+func (s *server) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	if err := s.state.resume(queueName); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error resuming queue", err)
+		return
+	}
+
+	sendQueue(w, r, s.visibleTo(r, s.describeQueue(queueName)))
+}
@@ -0,0 +1,214 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "pausetest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	pausereq, err := http.NewRequest("POST", "/queues/pausetest/pause", nil)
+	assert.Nil(t, err)
+
+	pauserr := httptest.NewRecorder()
+	Router()(pauserr, pausereq)
+
+	assert.Equal(t, http.StatusOK, pauserr.Code)
+	info := queueInfo{}
+	assert.Nil(t, json.Unmarshal(pauserr.Body.Bytes(), &info))
+	assert.True(t, info.Paused)
+	assert.NotNil(t, info.PausedAt)
+
+	pubreq, err := http.NewRequest("POST", "/queues/pausetest", strings.NewReader(`{"body": "paused"}`))
+	assert.Nil(t, err)
+	pubreq.Header.Set("Content-Type", "application/json")
+
+	pubrr := httptest.NewRecorder()
+	Router()(pubrr, pubreq)
+	assert.Equal(t, http.StatusCreated, pubrr.Code)
+
+	for _, path := range []string{"/queues/pausetest", "/queues/pausetest/pop-many", "/queues/pausetest/stream"} {
+		subreq, err := http.NewRequest("GET", path, nil)
+		assert.Nil(t, err)
+
+		subrr := httptest.NewRecorder()
+		Router()(subrr, subreq)
+		assert.Equal(t, http.StatusLocked, subrr.Code, path)
+	}
+
+	listreq, err := http.NewRequest("GET", "/queues", nil)
+	assert.Nil(t, err)
+
+	listrr := httptest.NewRecorder()
+	Router()(listrr, listreq)
+	listed := []queueInfo{}
+	assert.Nil(t, json.Unmarshal(listrr.Body.Bytes(), &listed))
+	for _, info := range listed {
+		assert.Equal(t, info.Name == "pausetest", info.Paused, info.Name)
+	}
+
+	resumereq, err := http.NewRequest("POST", "/queues/pausetest/resume", nil)
+	assert.Nil(t, err)
+
+	resumerr := httptest.NewRecorder()
+	Router()(resumerr, resumereq)
+	assert.Equal(t, http.StatusOK, resumerr.Code)
+
+	subreq, err := http.NewRequest("GET", "/queues/pausetest?wait=5s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+	assert.Equal(t, http.StatusOK, subrr.Code)
+	task := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(subrr.Body.Bytes(), &task))
+	assert.Equal(t, "paused", task.Body)
+}
+
+func TestPauseDuringLongPoll(t *testing.T) {
+	subreq, err := http.NewRequest("GET", "/queues/pausetest?wait=10s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Router()(subrr, subreq)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, testServer.state.pause("pausetest"))
+	defer testServer.state.resume("pausetest")
+
+	fixture := kewpie.Task{
+		Body: "published while paused",
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "pausetest", &fixture))
+
+	<-done
+	assert.Equal(t, http.StatusLocked, subrr.Code)
+
+	// The task went back on the queue
+	assert.Nil(t, testServer.state.resume("pausetest"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	task, err := testServer.claim(ctx, "pausetest", func(kewpie.Task) (bool, error) {
+		return false, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, fixture.Body, task.Body)
+	assert.Equal(t, 0, task.Attempts)
+}
+
+func TestPauseEmptyQueueDuringLongPoll(t *testing.T) {
+	s := memoryServer(t, map[string]config.QueueSettings{
+		"pauseemptytest": config.QueueSettings{},
+	})
+
+	subreq, err := http.NewRequest("GET", "/queues/pauseemptytest?wait=10s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeHTTP(subrr, subreq)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, s.state.pause("pauseemptytest"))
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The long poll carried on waiting after the queue was paused")
+	}
+	assert.Equal(t, http.StatusLocked, subrr.Code)
+}
+
+func TestStateStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kewpie_http_state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testServer.state.json")
+
+	store := newStateStore(path)
+	assert.Nil(t, store.load())
+	assert.Nil(t, store.pause("foo"))
+
+	reloaded := newStateStore(path)
+	assert.Nil(t, reloaded.load())
+	assert.True(t, reloaded.paused("foo"))
+	assert.False(t, reloaded.paused("bar"))
+
+	assert.Nil(t, reloaded.resume("foo"))
+	assert.Nil(t, store.load())
+	assert.False(t, store.paused("foo"))
+}
+
+func TestStateStoreLoadOnlyNotifiesChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kewpie_http_state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	store := newStateStore(path)
+	other := newStateStore(path)
+	assert.Nil(t, store.pause("foo"))
+
+	_, changed := store.watch()
+	assert.Nil(t, store.load())
+	select {
+	case <-changed:
+		t.Fatal("Reading the state it already had told watchers it changed")
+	default:
+	}
+
+	// Another process resuming it is picked up the next time it's read
+	assert.Nil(t, other.load())
+	assert.Nil(t, other.resume("foo"))
+	assert.Nil(t, store.load())
+	select {
+	case <-changed:
+	default:
+		t.Fatal("Reading a changed state didn't tell watchers")
+	}
+	assert.False(t, store.paused("foo"))
+}
+
+func TestWaitResumed(t *testing.T) {
+	store := newStateStore("")
+	assert.Nil(t, store.pause("foo"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	untilPaused, stop := store.untilPaused(ctx, "bar")
+	defer stop()
+
+	go store.resume("foo")
+	assert.Nil(t, store.waitResumed(ctx, "foo"))
+	assert.Nil(t, untilPaused.Err())
+
+	assert.Nil(t, store.pause("bar"))
+	<-untilPaused.Done()
+	assert.Nil(t, ctx.Err())
+}
@@ -0,0 +1,57 @@
+package kewpiehttp
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// connectPostgres opens a direct handle on the database behind the postgres
+// backend, for the things the kewpie library doesn't do itself
+func connectPostgres() (*sql.DB, error) {
+	return sql.Open("postgres", os.Getenv("DB_URI"))
+}
+
+// migratePostgres creates the tables kewpie_http keeps in the database itself
+func migratePostgres(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS kewpie_http_idempotency (
+key TEXT PRIMARY KEY,
+task JSONB NOT NULL,
+created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+)`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS kewpie_http_state (
+id INT PRIMARY KEY,
+state JSONB NOT NULL
+)`)
+	return err
+}
+
+// createQueueTable creates the table the postgres backend keeps a queue in,
+// the same way the backend does when it connects
+func createQueueTable(db *sql.DB, queueName string) error {
+	table := tableFor(queueName)
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+id UUID PRIMARY KEY,
+body TEXT NOT NULL DEFAULT '',
+delay BIGINT NOT NULL DEFAULT 0,
+run_at TIMESTAMPTZ default NOW(),
+created_at TIMESTAMPTZ default NOW(),
+no_exp_backoff BOOL NOT NULL DEFAULT false,
+attempts int NOT NULL DEFAULT 0
+)`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '{}'::jsonb`)
+	return err
+}
+
+// tableFor is the name of the table the postgres backend keeps a queue in
+func tableFor(queueName string) string {
+	name := strings.Replace(queueName, " ", "_", -1)
+	name = strings.Replace(name, "-", "_", -1)
+	return "kewpie_" + strings.ToLower(name)
+}
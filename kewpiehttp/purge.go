@@ -0,0 +1,189 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+)
+
+var errPurgeFilterUnsupported = errors.New("Purging by tag or run_at is only supported on the postgres backend")
+var errDryRunUnsupported = errors.New("Dry runs are only supported on the postgres backend")
+
+// purgeSample is how many of the tasks a dry run would remove are returned
+const purgeSample = 10
+
+// purgeParams are the query params a purge understands, besides tag filters
+var purgeParams = map[string]bool{
+	"matching":   true,
+	"run_after":  true,
+	"run_before": true,
+	"dry_run":    true,
+}
+
+// unknownPurgeParam is the first query param a purge doesn't understand, if
+// there is one. A mistyped filter would otherwise purge the whole queue.
+func unknownPurgeParam(values url.Values) string {
+	params := []string{}
+	for param := range values {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+
+	for _, param := range params {
+		if purgeParams[param] {
+			continue
+		}
+		if strings.HasPrefix(param, tagParamPrefix) && param != tagParamPrefix {
+			continue
+		}
+		return param
+	}
+	return ""
+}
+
+// purgeTasks removes the tasks on the named queue that match the filter and
+// reports how many there were. Backends that can't count what they removed
+// report nil.
+func (s *server) purgeTasks(ctx context.Context, queueName string, filter taskFilter) (*int64, error) {
+	pg := s.pgFor(queueName)
+	if pg == nil {
+		if len(filter.Tags) > 0 || !filter.RunAfter.IsZero() || !filter.RunBefore.IsZero() {
+			return nil, errPurgeFilterUnsupported
+		}
+		if filter.Matching != "" {
+			return nil, s.queue.PurgeMatching(ctx, queueName, filter.Matching)
+		}
+		return nil, s.queue.Purge(ctx, queueName)
+	}
+
+	query := `DELETE FROM ` + tableFor(queueName)
+	conditions, args := filter.where(nil)
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+
+	res, err := pg.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	return &removed, nil
+}
+
+// previewPurge counts the tasks on the named queue that match the filter,
+// without removing them, and returns a sample of them
+func (s *server) previewPurge(ctx context.Context, queueName string, filter taskFilter) (int64, []kewpie.Task, error) {
+	pg := s.pgFor(queueName)
+	if pg == nil {
+		return 0, nil, errDryRunUnsupported
+	}
+
+	where := ""
+	conditions, args := filter.where(nil)
+	if len(conditions) > 0 {
+		where = ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+
+	var count int64
+	if err := pg.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+tableFor(queueName)+where, args...).Scan(&count); err != nil {
+		return 0, nil, err
+	}
+
+	rows, err := pg.QueryContext(ctx, `SELECT `+taskColumns+` FROM `+tableFor(queueName)+where+` ORDER BY created_at, id LIMIT `+strconv.Itoa(purgeSample), args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	sample := []kewpie.Task{}
+	for rows.Next() {
+		task := kewpie.Task{}
+		if err := rows.Scan(&task.ID, &task.Body, &task.Delay, &task.RunAt, &task.NoExpBackoff, &task.Attempts, &task.Tags); err != nil {
+			return 0, nil, err
+		}
+		sample = append(sample, task)
+	}
+
+	return count, sample, rows.Err()
+}
+
+type purgeResult struct {
+	Removed *int64 `json:"removed"`
+}
+
+type jsonAPIMetaPayload struct {
+	Errors []map[string]string `json:"errors"`
+	Meta   map[string]string   `json:"meta"`
+}
+
+func sendPurged(w http.ResponseWriter, r *http.Request, removed *int64) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		payload := jsonAPIMetaPayload{
+			Meta: map[string]string{},
+		}
+		if removed != nil {
+			payload.Meta["removed"] = strconv.FormatInt(*removed, 10)
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(purgeResult{Removed: removed}); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+	}
+}
+
+type purgePreview struct {
+	DryRun bool          `json:"dry_run"`
+	Count  int64         `json:"count"`
+	Sample []kewpie.Task `json:"sample"`
+}
+
+// sendPurgePreview sends the count and sample from a dry run. For JSON-API
+// the sample is the data and the count is in meta.
+func sendPurgePreview(w http.ResponseWriter, r *http.Request, count int64, sample []kewpie.Task) {
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		w.Header().Set("Content-Type", "application/json")
+		payload := jsonAPIManyPayload{
+			Data: []jsonAPIData{},
+			Meta: map[string]string{
+				"dry_run": "true",
+				"count":   strconv.FormatInt(count, 10),
+			},
+		}
+		for _, task := range sample {
+			payload.Data = append(payload.Data, jsonAPIData{
+				Type:       "jobs",
+				ID:         task.ID,
+				Attributes: task,
+			})
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(purgePreview{
+		DryRun: true,
+		Count:  count,
+		Sample: sample,
+	}); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+	}
+}
@@ -0,0 +1,182 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "purgetagstest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestPurgeByTag(t *testing.T) {
+	if testServer.pg == nil {
+		req, err := http.NewRequest("DELETE", "/queues/purgetagstest?tag.customer=123", nil)
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusNotImplemented, rr.Code)
+		t.Skip("Purging by tag needs the postgres backend")
+	}
+
+	ctx := context.Background()
+	customer := uuid.NewV4().String()
+	for _, tags := range []kewpie.Tags{
+		{"customer": customer, "kind": "invoice"},
+		{"customer": customer, "kind": "reminder"},
+		{"customer": uuid.NewV4().String(), "kind": "invoice"},
+	} {
+		fixture := kewpie.Task{
+			Body: `{"hi": "purge"}`,
+			Tags: tags,
+		}
+		assert.Nil(t, testServer.queue.Publish(ctx, "purgetagstest", &fixture))
+	}
+
+	req, err := http.NewRequest("DELETE", "/queues/purgetagstest?tag.customer="+customer+"&tag.kind=invoice", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	res := purgeResult{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	if assert.NotNil(t, res.Removed) {
+		assert.Equal(t, int64(1), *res.Removed)
+	}
+
+	allreq, err := http.NewRequest("DELETE", "/queues/purgetagstest", nil)
+	assert.Nil(t, err)
+	allreq.Header.Set("Accept", "application/vnd.api+json")
+
+	allrr := httptest.NewRecorder()
+	Router()(allrr, allreq)
+
+	assert.Equal(t, http.StatusOK, allrr.Code)
+	all := jsonAPIMetaPayload{}
+	assert.Nil(t, json.Unmarshal(allrr.Body.Bytes(), &all))
+	assert.Equal(t, "2", all.Meta["removed"])
+}
+
+func TestPurgeCountUnknown(t *testing.T) {
+	if testServer.pg != nil {
+		t.Skip("Postgres can count what it purges")
+	}
+
+	req, err := http.NewRequest("DELETE", "/queues/purgetagstest", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"removed": null}`, rr.Body.String())
+}
+
+func TestPurgeDryRun(t *testing.T) {
+	ctx := context.Background()
+	customer := uuid.NewV4().String()
+	fixture := kewpie.Task{
+		Body: `{"hi": "dry run"}`,
+		Tags: kewpie.Tags{"customer": customer},
+	}
+	assert.Nil(t, testServer.queue.Publish(ctx, "purgetagstest", &fixture))
+
+	req, err := http.NewRequest("DELETE", "/queues/purgetagstest?dry_run=true&tag.customer="+customer, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/vnd.api+json")
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	if testServer.pg == nil {
+		assert.Equal(t, http.StatusNotImplemented, rr.Code)
+	} else {
+		assert.Equal(t, http.StatusOK, rr.Code)
+		res := jsonAPIManyPayload{}
+		assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+		assert.Equal(t, "1", res.Meta["count"])
+		if assert.Equal(t, 1, len(res.Data)) {
+			assert.Equal(t, fixture.ID, res.Data[0].ID)
+		}
+	}
+
+	// Nothing was removed
+	popctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	task, err := testServer.claim(popctx, "purgetagstest", func(task kewpie.Task) (bool, error) {
+		return false, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, fixture.ID, task.ID)
+}
+
+func TestPurgeDryRunValues(t *testing.T) {
+	// Anything strconv.ParseBool takes as true is a dry run, and nothing is
+	// purged on the strength of a value that can't be parsed
+	for value, expected := range map[string]int{
+		"1":    http.StatusOK,
+		"TRUE": http.StatusOK,
+		"yes":  http.StatusBadRequest,
+		"sure": http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest("DELETE", "/queues/purgetagstest?dry_run="+value+"&matching=nothing_matches_this", nil)
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		if expected == http.StatusOK && testServer.pg == nil {
+			expected = http.StatusNotImplemented
+		}
+		assert.Equal(t, expected, rr.Code, value)
+		assert.NotContains(t, rr.Body.String(), "removed", value)
+	}
+}
+
+func TestPurgeUnknownParams(t *testing.T) {
+	ctx := context.Background()
+	fixture := kewpie.Task{
+		Body: `{"hi": "not purged by a typo"}`,
+	}
+	assert.Nil(t, testServer.queue.Publish(ctx, "purgetagstest", &fixture))
+
+	for _, query := range []string{
+		"tags.customer=foo",
+		"tag=foo",
+		"tag.=foo",
+		"matchin=foo",
+		"tag.customer=foo&dryrun=true",
+	} {
+		req, err := http.NewRequest("DELETE", "/queues/purgetagstest?"+query, nil)
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+
+	// Nothing was removed
+	popctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	task, err := testServer.claim(popctx, "purgetagstest", func(task kewpie.Task) (bool, error) {
+		return false, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, fixture.ID, task.ID)
+}
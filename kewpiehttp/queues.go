@@ -0,0 +1,125 @@
+package kewpiehttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/paidright/kewpie_http/config"
+)
+
+// queueInfo describes a configured queue and the settings it was declared with
+type queueInfo struct {
+	Name        string             `json:"name"`
+	Source      string             `json:"source"`
+	Backend     string             `json:"backend"`
+	Webhook     string             `json:"webhook,omitempty"`
+	MaxAttempts int                `json:"max_attempts,omitempty"`
+	DeadLetter  string             `json:"dead_letter,omitempty"`
+	Schema      *config.Schema     `json:"schema,omitempty"`
+	Auth        *config.Auth       `json:"auth,omitempty"`
+	RateLimits  *config.RateLimits `json:"rate_limits,omitempty"`
+	Paused      bool               `json:"paused"`
+	PausedAt    *time.Time         `json:"paused_at,omitempty"`
+}
+
+type jsonAPIQueueData struct {
+	Type       string    `json:"type"`
+	ID         string    `json:"id"`
+	Attributes queueInfo `json:"attributes"`
+}
+
+type jsonAPIQueuePayload struct {
+	Errors []map[string]string `json:"errors"`
+	Data   jsonAPIQueueData    `json:"data"`
+	Meta   map[string]string   `json:"meta"`
+}
+
+type jsonAPIQueuesPayload struct {
+	Errors []map[string]string `json:"errors"`
+	Data   []jsonAPIQueueData  `json:"data"`
+	Meta   map[string]string   `json:"meta"`
+}
+
+func (s *server) describeQueue(name string) queueInfo {
+	settings, _ := s.queue.settingsFor(name)
+	info := queueInfo{
+		Name:        name,
+		Source:      settings.Source,
+		Backend:     s.queue.kindOf(name),
+		Webhook:     settings.Webhook,
+		MaxAttempts: settings.MaxAttempts,
+		DeadLetter:  settings.DeadLetter,
+		Schema:      settings.Schema,
+		Auth:        settings.Auth,
+		RateLimits:  settings.RateLimits,
+	}
+	if at, ok := s.state.pausedAt(name); ok {
+		info.Paused = true
+		info.PausedAt = &at
+	}
+	return info
+}
+
+// visibleTo leaves out the settings only the admin token can see. Webhook URLs
+// often carry credentials, and auth settings name the API keys.
+func (s *server) visibleTo(r *http.Request, info queueInfo) queueInfo {
+	if s.isAdmin(bearerToken(r)) {
+		return info
+	}
+	info.Webhook = ""
+	info.Auth = nil
+	return info
+}
+
+func (s *server) queuesHandler(w http.ResponseWriter, r *http.Request) {
+	queues := []queueInfo{}
+	for _, name := range s.queue.names() {
+		queues = append(queues, s.visibleTo(r, s.describeQueue(name)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		payload := jsonAPIQueuesPayload{
+			Data: []jsonAPIQueueData{},
+		}
+		for _, info := range queues {
+			payload.Data = append(payload.Data, jsonAPIQueueData{
+				Type:       "queues",
+				ID:         info.Name,
+				Attributes: info,
+			})
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(queues); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+	}
+}
+
+func sendQueue(w http.ResponseWriter, r *http.Request, info queueInfo) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		payload := jsonAPIQueuePayload{
+			Data: jsonAPIQueueData{
+				Type:       "queues",
+				ID:         info.Name,
+				Attributes: info,
+			},
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+	}
+}
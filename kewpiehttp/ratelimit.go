@@ -0,0 +1,104 @@
+package kewpiehttp
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/paidright/kewpie_http/config"
+)
+
+// bucket is a token bucket for one scope on one queue
+type bucket struct {
+	limit  config.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if there is one. If there isn't, it says how long until
+// there will be.
+func (b *bucket) take(now time.Time) (bool, time.Duration) {
+	capacity := float64(b.limit.Burst)
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / b.limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: map[string]*bucket{},
+	}
+}
+
+// allow takes a token for the scope on the queue. A bucket starts full, and
+// starts again full if the limit it was made for changes.
+func (l *rateLimiter) allow(queueName, scope string, limit config.RateLimit) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	key := queueName + "/" + scope
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{
+			limit:  limit,
+			tokens: math.Max(1, float64(limit.Burst)),
+			last:   time.Now(),
+		}
+		l.buckets[key] = b
+	}
+
+	return b.take(time.Now())
+}
+
+func limitFor(settings config.QueueSettings, scope string) *config.RateLimit {
+	if settings.RateLimits == nil {
+		return nil
+	}
+	switch scope {
+	case "publish":
+		return settings.RateLimits.Publish
+	case "consume":
+		return settings.RateLimits.Consume
+	}
+	return nil
+}
+
+// rateLimited turns requests away once the queue's rate limit for the scope
+// has been used up
+func (s *server) rateLimited(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queueName := queueName(r)
+		settings, _ := s.queue.settingsFor(queueName)
+
+		limit := limitFor(settings, scope)
+		if limit == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, wait := s.limiter.allow(queueName, scope, *limit); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			errRes(w, r, http.StatusTooManyRequests, "Rate limit exceeded. Try again after the number of seconds in the Retry-After header", nil)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,403 @@
+package kewpiehttp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/davidbanham/kewpie_go/types"
+	"github.com/paidright/kewpie_http/config"
+)
+
+// runtimeSource is the Source of queues registered through the admin API
+// rather than declared in env vars
+const runtimeSource = "runtime"
+
+var errDeclaredQueue = errors.New("That queue is declared in an env var and can't be changed at runtime")
+
+var errBackendChanged = errors.New("A queue can't be moved to another backend while it's registered. Unregister it first")
+
+var errBackendNotConnected = errors.New("That backend isn't connected. Queues can only use a backend that was connected when kewpie_http started")
+
+type registeredQueue struct {
+	backend Queue
+	// owned is whether the queue has a connection of its own, rather than
+	// sharing one with the other queues of its kind, and so can close it
+	owned bool
+	// kind is the kind of backend, eg: postgres
+	kind     string
+	settings config.QueueSettings
+	// ctx is cancelled when the queue is unregistered, stopping anything
+	// running on its behalf, like webhook delivery
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// queueRegistry is the set of queues being served and the backend connection
+// each of them uses. Queues share one connection per kind of backend where the
+// backend allows it. Only the kinds connected at startup can be used. It has
+// the same methods as Queue, and sends each call to the backend for the named
+// queue.
+type queueRegistry struct {
+	sync.RWMutex
+	// backend is the kind of backend queues use unless their settings say
+	// otherwise
+	backend string
+	queues  map[string]*registeredQueue
+	// conns is the shared connection to each kind of backend
+	conns map[string]Queue
+	// db is a direct handle on the database behind the postgres backend, for
+	// creating the tables of queues added while running
+	db *sql.DB
+}
+
+func newQueueRegistry(backend string) *queueRegistry {
+	return &queueRegistry{
+		backend: backend,
+		queues:  map[string]*registeredQueue{},
+		conns:   map[string]Queue{},
+	}
+}
+
+// kindFor is the kind of backend a queue with the settings is kept in
+func (reg *queueRegistry) kindFor(settings config.QueueSettings) string {
+	if settings.Backend != "" {
+		return settings.Backend
+	}
+	return reg.backend
+}
+
+// connect connects the queues declared in the config to their backends. A
+// backend that fails to connect doesn't stop the others, but its queues
+// aren't served.
+func (reg *queueRegistry) connect(names []string, settings map[string]config.QueueSettings) error {
+	byKind := map[string][]string{}
+	for _, name := range names {
+		kind := reg.kindFor(settings[name])
+		byKind[kind] = append(byKind[kind], name)
+	}
+
+	var failed error
+	for kind, names := range byKind {
+		conn := &kewpie.Kewpie{}
+		if err := conn.Connect(kind, names); err != nil {
+			failed = fmt.Errorf("connecting to %s: %v", kind, err)
+			continue
+		}
+		reg.attach(conn, kind, names, settings)
+	}
+	return failed
+}
+
+// attach serves the named queues from a backend that's already connected, and
+// shares it with queues of the same kind added later
+func (reg *queueRegistry) attach(conn Queue, kind string, names []string, settings map[string]config.QueueSettings) {
+	if conn == nil {
+		return
+	}
+	reg.Lock()
+	defer reg.Unlock()
+	if _, ok := reg.conns[kind]; !ok {
+		reg.conns[kind] = conn
+	}
+	for _, name := range names {
+		ctx, cancel := context.WithCancel(context.Background())
+		reg.queues[name] = &registeredQueue{
+			backend:  conn,
+			kind:     kind,
+			settings: settings[name],
+			ctx:      ctx,
+			cancel:   cancel,
+		}
+	}
+}
+
+// register connects a queue at runtime. A queue that was already registered
+// at runtime has its settings replaced, and reports false.
+func (reg *queueRegistry) register(name string, settings config.QueueSettings) (bool, error) {
+	settings.Source = runtimeSource
+
+	reg.Lock()
+	existing, ok := reg.queues[name]
+	if ok {
+		defer reg.Unlock()
+		if existing.settings.Source != runtimeSource {
+			return false, errDeclaredQueue
+		}
+		if existing.kind != reg.kindFor(settings) {
+			return false, errBackendChanged
+		}
+		existing.cancel()
+		existing.settings = settings
+		existing.ctx, existing.cancel = context.WithCancel(context.Background())
+		return false, nil
+	}
+	reg.Unlock()
+
+	// Connecting can take a while, so don't hold everyone else up
+	opened, err := reg.open(name, settings)
+	if err != nil {
+		return false, err
+	}
+
+	reg.Lock()
+	if _, ok := reg.queues[name]; ok {
+		// Someone else registered it while we were connecting
+		reg.Unlock()
+		opened.close()
+		return reg.register(name, settings)
+	}
+	opened.ctx, opened.cancel = context.WithCancel(context.Background())
+	reg.queues[name] = opened
+	reg.Unlock()
+	return true, nil
+}
+
+// open connects a queue that wasn't there at startup, without adding it. It's
+// refused if its kind of backend wasn't connected at startup, rather than
+// connecting to a backend that may not be configured.
+func (reg *queueRegistry) open(name string, settings config.QueueSettings) (*registeredQueue, error) {
+	kind := reg.kindFor(settings)
+
+	reg.RLock()
+	shared, ok := reg.conns[kind]
+	db := reg.db
+	reg.RUnlock()
+	if !ok {
+		return nil, errBackendNotConnected
+	}
+
+	opened := &registeredQueue{
+		kind:     kind,
+		settings: settings,
+	}
+
+	if kind == "postgres" {
+		// The postgres backend finds a queue by its table, so once the table
+		// exists the shared connection can serve it
+		if db == nil {
+			return nil, errBackendNotConnected
+		}
+		if err := createQueueTable(db, name); err != nil {
+			return nil, err
+		}
+		opened.backend = shared
+		return opened, nil
+	}
+
+	// The other backends only serve the queues they were connected with. They
+	// don't keep a pool of connections, so the queue can have its own.
+	conn := &kewpie.Kewpie{}
+	if err := conn.Connect(kind, []string{name}); err != nil {
+		return nil, err
+	}
+	opened.backend = conn
+	opened.owned = true
+	return opened, nil
+}
+
+// close closes the queue's connection, if it has one of its own
+func (q *registeredQueue) close() error {
+	if !q.owned {
+		return nil
+	}
+	if conn, ok := q.backend.(disconnecter); ok {
+		return conn.Disconnect()
+	}
+	return nil
+}
+
+// reconfigure replaces the settings of queues declared in the config, and
+// adds the ones in added, all at once. Queues whose settings change get a new
+// context, so anything running with the old settings stops.
+func (reg *queueRegistry) reconfigure(settings map[string]config.QueueSettings, added map[string]*registeredQueue) {
+	reg.Lock()
+	defer reg.Unlock()
+
+	for name, q := range added {
+		q.ctx, q.cancel = context.WithCancel(context.Background())
+		reg.queues[name] = q
+	}
+
+	for name, q := range reg.queues {
+		updated, ok := settings[name]
+		if !ok || q.settings.Source == runtimeSource || reflect.DeepEqual(q.settings, updated) {
+			continue
+		}
+		q.cancel()
+		q.settings = updated
+		q.ctx, q.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// unregister stops serving a queue that was registered at runtime. Its tasks
+// are left in the backend.
+func (reg *queueRegistry) unregister(name string) error {
+	reg.Lock()
+	existing, ok := reg.queues[name]
+	if !ok {
+		reg.Unlock()
+		return types.QueueNotFound
+	}
+	if existing.settings.Source != runtimeSource {
+		reg.Unlock()
+		return errDeclaredQueue
+	}
+	delete(reg.queues, name)
+	reg.Unlock()
+
+	existing.cancel()
+	return existing.close()
+}
+
+// backendFor is the connection the named queue uses, or nil if there is no
+// such queue
+func (reg *queueRegistry) backendFor(name string) Queue {
+	reg.RLock()
+	defer reg.RUnlock()
+	if q, ok := reg.queues[name]; ok {
+		return q.backend
+	}
+	return nil
+}
+
+func (reg *queueRegistry) settingsFor(name string) (config.QueueSettings, bool) {
+	reg.RLock()
+	defer reg.RUnlock()
+	if q, ok := reg.queues[name]; ok {
+		return q.settings, true
+	}
+	return config.QueueSettings{}, false
+}
+
+// kindOf is the kind of backend the named queue is kept in, or empty if there
+// is no such queue
+func (reg *queueRegistry) kindOf(name string) string {
+	reg.RLock()
+	defer reg.RUnlock()
+	if q, ok := reg.queues[name]; ok {
+		return q.kind
+	}
+	return ""
+}
+
+// contextFor is cancelled when the named queue is unregistered or has its
+// settings replaced
+func (reg *queueRegistry) contextFor(name string) context.Context {
+	reg.RLock()
+	defer reg.RUnlock()
+	if q, ok := reg.queues[name]; ok {
+		return q.ctx
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func (reg *queueRegistry) names() []string {
+	reg.RLock()
+	defer reg.RUnlock()
+	names := []string{}
+	for name := range reg.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (reg *queueRegistry) Publish(ctx context.Context, queueName string, payload *kewpie.Task) error {
+	backend := reg.backendFor(queueName)
+	if backend == nil {
+		return types.QueueNotFound
+	}
+	return backend.Publish(ctx, queueName, payload)
+}
+
+func (reg *queueRegistry) Pop(ctx context.Context, queueName string, handler types.Handler) error {
+	backend := reg.backendFor(queueName)
+	if backend == nil {
+		return types.QueueNotFound
+	}
+	return backend.Pop(ctx, queueName, handler)
+}
+
+func (reg *queueRegistry) Subscribe(ctx context.Context, queueName string, handler types.Handler) error {
+	backend := reg.backendFor(queueName)
+	if backend == nil {
+		return types.QueueNotFound
+	}
+	return backend.Subscribe(ctx, queueName, handler)
+}
+
+func (reg *queueRegistry) Purge(ctx context.Context, queueName string) error {
+	backend := reg.backendFor(queueName)
+	if backend == nil {
+		return types.QueueNotFound
+	}
+	return backend.Purge(ctx, queueName)
+}
+
+func (reg *queueRegistry) PurgeMatching(ctx context.Context, queueName, substr string) error {
+	backend := reg.backendFor(queueName)
+	if backend == nil {
+		return types.QueueNotFound
+	}
+	return backend.PurgeMatching(ctx, queueName, substr)
+}
+
+// backendHealth is how one kind of backend is doing, and the queues kept in it
+type backendHealth struct {
+	Backend string   `json:"backend"`
+	Healthy bool     `json:"healthy"`
+	Error   string   `json:"error,omitempty"`
+	Queues  []string `json:"queues"`
+}
+
+// health checks every backend connection, and reports on each kind of backend
+// in order
+func (reg *queueRegistry) health(ctx context.Context) []backendHealth {
+	reg.RLock()
+	// Each kind's shared connection is checked once, along with any queues'
+	// own. A Queue needn't be hashable, so they aren't deduplicated in a map.
+	conns := map[string][]Queue{}
+	queues := map[string][]string{}
+	for name, q := range reg.queues {
+		if q.owned {
+			conns[q.kind] = append(conns[q.kind], q.backend)
+		}
+		queues[q.kind] = append(queues[q.kind], name)
+	}
+	for kind := range queues {
+		if conn, ok := reg.conns[kind]; ok {
+			conns[kind] = append(conns[kind], conn)
+		}
+	}
+	reg.RUnlock()
+
+	report := []backendHealth{}
+	for kind, backends := range conns {
+		health := backendHealth{
+			Backend: kind,
+			Healthy: true,
+			Queues:  queues[kind],
+		}
+		sort.Strings(health.Queues)
+		for _, backend := range backends {
+			if err := backend.Healthy(ctx); err != nil {
+				health.Healthy = false
+				health.Error = err.Error()
+				break
+			}
+		}
+		report = append(report, health)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Backend < report[j].Backend
+	})
+	return report
+}
@@ -0,0 +1,244 @@
+package kewpiehttp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/paidright/kewpie_http/config"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// reloadConfig reads the config again and applies whatever can be changed
+// while running: queue settings, API keys, the admin token and rate limits.
+// If the new config is invalid, the running one is kept.
+func (s *server) reloadConfig() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	running := s.config()
+	conf, err := config.Load()
+	if err != nil {
+		log.Println("ERROR rejected reloaded config, keeping the running one.", err)
+		return err
+	}
+
+	for _, change := range restartOnly(running, conf) {
+		log.Println("WARN", change, "- restart kewpie_http to apply it")
+	}
+
+	// Connect new queues before changing anything, so a failure leaves
+	// everything as it was
+	added := map[string]*registeredQueue{}
+	changes := []string{}
+	for _, name := range conf.Names() {
+		current, ok := s.queue.settingsFor(name)
+		if !ok {
+			opened, err := s.queue.open(name, conf.Queues[name])
+			if err != nil {
+				for _, q := range added {
+					q.close()
+				}
+				log.Println("ERROR rejected reloaded config, keeping the running one. Failed to connect queue", name, err)
+				return err
+			}
+			added[name] = opened
+			changes = append(changes, "queue "+name+" added")
+			continue
+		}
+		if current.Source == runtimeSource {
+			log.Println("WARN queue", name, "was registered at runtime, so its settings in the config are ignored")
+			continue
+		}
+		if kind := s.queue.kindFor(conf.Queues[name]); kind != s.queue.kindOf(name) {
+			log.Println("WARN queue", name, "backend changed from", s.queue.kindOf(name), "to", kind, "- restart kewpie_http to apply it")
+			// Keep the queue where it is until then
+			settings := conf.Queues[name]
+			settings.Backend = current.Backend
+			conf.Queues[name] = settings
+		}
+		changes = append(changes, diffSettings(name, current, conf.Queues[name])...)
+	}
+	for _, name := range s.queue.names() {
+		current, _ := s.queue.settingsFor(name)
+		if _, ok := conf.Queues[name]; !ok && current.Source != runtimeSource {
+			log.Println("WARN queue", name, "is no longer in the config - restart kewpie_http to stop serving it")
+		}
+	}
+
+	changes = append(changes, diffKeys(running.APIKeys, conf.APIKeys)...)
+	if running.AdminToken != conf.AdminToken {
+		changes = append(changes, "admin token changed")
+	}
+
+	// Anything that needs a restart keeps its running value
+	updated := running
+	updated.APIKeys = conf.APIKeys
+	updated.AdminToken = conf.AdminToken
+	updated.Queues = conf.Queues
+
+	s.confLock.Lock()
+	s.queue.reconfigure(conf.Queues, added)
+	s.conf = updated
+	s.confLock.Unlock()
+
+	// Webhooks were stopped for the queues that changed, so start them again
+	// with their new settings
+	for _, name := range conf.Names() {
+		if added[name] != nil || changed(changes, name) {
+			s.startWebhook(s.ctx, name)
+		}
+	}
+
+	if len(changes) == 0 {
+		log.Println("INFO reloaded config, nothing changed")
+	}
+	for _, change := range changes {
+		log.Println("INFO reloaded config,", change)
+	}
+	return nil
+}
+
+// changed is whether any of the changes were to the named queue
+func changed(changes []string, name string) bool {
+	for _, change := range changes {
+		if strings.HasPrefix(change, "queue "+name+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// restartOnly lists the changes that can't be made while running
+func restartOnly(running, conf config.Config) []string {
+	changes := []string{}
+	if conf.Backend != running.Backend {
+		changes = append(changes, fmt.Sprintf("backend changed from %s to %s", running.Backend, conf.Backend))
+	}
+	if conf.Port != running.Port {
+		changes = append(changes, fmt.Sprintf("port changed from %d to %d", running.Port, conf.Port))
+	}
+	if conf.StateFile != running.StateFile {
+		changes = append(changes, fmt.Sprintf("state file changed from %s to %s", running.StateFile, conf.StateFile))
+	}
+	if conf.IdempotencyWindow != running.IdempotencyWindow {
+		changes = append(changes, fmt.Sprintf("idempotency window changed from %s to %s", running.IdempotencyWindow, conf.IdempotencyWindow))
+	}
+	return changes
+}
+
+// diffSettings describes how a queue's settings changed
+func diffSettings(name string, before, after config.QueueSettings) []string {
+	changes := []string{}
+	prefix := "queue " + name + " "
+
+	if before.Webhook != after.Webhook {
+		changes = append(changes, fmt.Sprintf("%swebhook changed from %q to %q", prefix, before.Webhook, after.Webhook))
+	}
+	if before.MaxAttempts != after.MaxAttempts {
+		changes = append(changes, fmt.Sprintf("%smax_attempts changed from %d to %d", prefix, before.MaxAttempts, after.MaxAttempts))
+	}
+	if before.DeadLetter != after.DeadLetter {
+		changes = append(changes, fmt.Sprintf("%sdead_letter changed from %q to %q", prefix, before.DeadLetter, after.DeadLetter))
+	}
+	if !reflect.DeepEqual(before.Schema, after.Schema) {
+		changes = append(changes, prefix+"schema changed")
+	}
+	if !reflect.DeepEqual(before.Auth, after.Auth) {
+		changes = append(changes, prefix+"auth changed")
+	}
+	if !reflect.DeepEqual(before.RateLimits, after.RateLimits) {
+		changes = append(changes, prefix+"rate_limits changed")
+	}
+	if before.Source != after.Source {
+		changes = append(changes, fmt.Sprintf("%snow declared in %s", prefix, after.Source))
+	}
+
+	return changes
+}
+
+// diffKeys describes which API keys changed, without giving the keys away
+func diffKeys(before, after map[string]string) []string {
+	names := map[string]bool{}
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	changes := []string{}
+	for _, name := range sorted {
+		old, had := before[name]
+		updated, has := after[name]
+		switch {
+		case !had:
+			changes = append(changes, "api key "+name+" added")
+		case !has:
+			changes = append(changes, "api key "+name+" removed")
+		case old != updated:
+			changes = append(changes, "api key "+name+" changed")
+		}
+	}
+	return changes
+}
+
+// watchConfig reloads the config on SIGHUP, and when the config file changes
+func (s *server) watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	path := s.config().Path
+	lastModified := modifiedAt(path)
+
+	go func() {
+		defer signal.Stop(hup)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Println("INFO reloading config on SIGHUP")
+				s.reloadConfig()
+			case <-ticker.C:
+				if path == "" {
+					continue
+				}
+				modified := modifiedAt(path)
+				if modified.Equal(lastModified) {
+					continue
+				}
+				lastModified = modified
+				log.Println("INFO reloading config,", path, "changed")
+				s.reloadConfig()
+			}
+		}
+	}()
+}
+
+func modifiedAt(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,128 @@
+package kewpiehttp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kewpie_reload")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "kewpie.yaml")
+
+	assert.Nil(t, os.Setenv("KEWPIE_CONFIG", path))
+	defer os.Unsetenv("KEWPIE_CONFIG")
+
+	// Keep the keys other tests use
+	keys := `
+admin_token: ` + testAdminToken + `
+api_keys:
+  producer: producerkey
+  consumer: consumerkey
+  reloader: reloaderkey
+`
+	assert.Nil(t, ioutil.WriteFile(path, []byte(keys+`
+queues:
+  reloadtest:
+    max_attempts: 4
+  reloadaddedtest: {}
+`), 0600))
+
+	// A long poll that's waiting when the config changes carries on
+	polled := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req, err := http.NewRequest("GET", "/queues/reloadtest?wait=5s", nil)
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+		polled <- rr
+	}()
+
+	assert.Nil(t, testServer.reloadConfig())
+
+	settings, ok := testServer.queue.settingsFor("reloadtest")
+	assert.True(t, ok)
+	assert.Equal(t, 4, settings.MaxAttempts)
+	assert.True(t, testServer.hasAPIKey("reloader"))
+
+	_, ok = testServer.queue.settingsFor("reloadaddedtest")
+	assert.True(t, ok)
+
+	pubreq, err := http.NewRequest("POST", "/queues/reloadtest", strings.NewReader(`{"body": "still polling"}`))
+	assert.Nil(t, err)
+	pubreq.Header.Set("Content-Type", "application/json")
+	pubrr := httptest.NewRecorder()
+	Router()(pubrr, pubreq)
+	assert.Equal(t, http.StatusCreated, pubrr.Code)
+
+	rr := <-polled
+	assert.Equal(t, http.StatusOK, rr.Code)
+	task := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &task))
+	assert.Equal(t, "still polling", task.Body)
+
+	// An invalid config is rejected as a whole
+	assert.Nil(t, ioutil.WriteFile(path, []byte(keys+`
+queues:
+  reloadtest:
+    max_attempts: 8
+  reloadbroken:
+    max_attempts: -1
+`), 0600))
+
+	err = testServer.reloadConfig()
+	assert.NotNil(t, err)
+	_, ok = err.(config.Errors)
+	assert.True(t, ok)
+
+	settings, _ = testServer.queue.settingsFor("reloadtest")
+	assert.Equal(t, 4, settings.MaxAttempts)
+	_, ok = testServer.queue.settingsFor("reloadbroken")
+	assert.False(t, ok)
+
+	// So is one that adds a queue in a backend that was never connected
+	assert.Nil(t, ioutil.WriteFile(path, []byte(keys+`
+queues:
+  reloadtest:
+    max_attempts: 8
+  reloadunconnected:
+    backend: sqs
+`), 0600))
+
+	assert.Equal(t, errBackendNotConnected, testServer.reloadConfig())
+	settings, _ = testServer.queue.settingsFor("reloadtest")
+	assert.Equal(t, 4, settings.MaxAttempts)
+	_, ok = testServer.queue.settingsFor("reloadunconnected")
+	assert.False(t, ok)
+}
+
+func TestDiffSettings(t *testing.T) {
+	before := config.QueueSettings{MaxAttempts: 3}
+	after := config.QueueSettings{
+		MaxAttempts: 5,
+		RateLimits:  &config.RateLimits{Publish: &config.RateLimit{Rate: 1}},
+	}
+
+	assert.Equal(t, []string{
+		"queue foo max_attempts changed from 3 to 5",
+		"queue foo rate_limits changed",
+	}, diffSettings("foo", before, after))
+
+	assert.Empty(t, diffSettings("foo", before, before))
+
+	assert.Equal(t, []string{
+		"api key a removed",
+		"api key b changed",
+		"api key c added",
+	}, diffKeys(map[string]string{"a": "1", "b": "2"}, map[string]string{"b": "3", "c": "4"}))
+}
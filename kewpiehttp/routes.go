@@ -0,0 +1,124 @@
+package kewpiehttp
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// methods maps the HTTP methods a route supports to the handler for each
+type methods map[string]http.HandlerFunc
+
+// route is a path pattern and the methods it supports. Segments of the pattern
+// starting with a colon are parameters, eg: /queues/:queue matches
+// /queues/foo with the queue parameter set to foo
+type route struct {
+	pattern string
+	methods methods
+}
+
+type paramsKey struct{}
+
+// match reports whether the path segments fit the route's pattern, and the
+// parameters they fill in if they do
+func (rt route) match(segments []string) (map[string]string, bool) {
+	pattern := pathSplit(rt.pattern)
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, part := range pattern {
+		if strings.HasPrefix(part, ":") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[part[1:]] = segments[i]
+			continue
+		}
+		if part != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (rt route) allowed() []string {
+	allowed := []string{}
+	for method := range rt.methods {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	return allowed
+}
+
+// routeTable dispatches a request to the first route that matches its path
+// and supports its method. If routes match the path but none of them support
+// the method, the client gets a 405 listing the methods that are supported.
+type routeTable []route
+
+// serve dispatches the request. Requests for queues that known doesn't
+// recognise get a 404.
+func (table routeTable) serve(w http.ResponseWriter, r *http.Request, known func(name string) bool) {
+	segments := pathSegments(r)
+
+	allowed := []string{}
+	for _, rt := range table {
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+
+		if name, ok := params["queue"]; ok && !known(name) {
+			errRes(w, r, http.StatusNotFound, "There is no queue called "+name, nil)
+			return
+		}
+
+		handler, ok := rt.methods[r.Method]
+		if !ok {
+			allowed = append(allowed, rt.allowed()...)
+			continue
+		}
+
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), paramsKey{}, params)))
+		return
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		errRes(w, r, http.StatusMethodNotAllowed, r.Method+" is not supported here. Use one of "+strings.Join(allowed, ", "), nil)
+		return
+	}
+
+	notFoundHandler.ServeHTTP(w, r)
+}
+
+// pathParam is the value of the named parameter in the pattern of the route
+// that matched the request
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// pathSegments splits the request path into its unescaped segments, ignoring
+// any trailing slash. /queues/foo%2Fbar/ becomes ["queues", "foo/bar"]
+func pathSegments(r *http.Request) []string {
+	segments := pathSplit(r.URL.EscapedPath())
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segments[i] = unescaped
+		}
+	}
+	return segments
+}
+
+func pathSplit(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
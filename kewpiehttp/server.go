@@ -0,0 +1,168 @@
+package kewpiehttp
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/paidright/kewpie_http/config"
+)
+
+// server is a kewpie_http instance, serving the queues in its config. Each
+// server keeps its own connections and state, so several can run in one
+// process.
+type server struct {
+	// confLock guards conf, which is swapped when the config is reloaded
+	confLock sync.RWMutex
+	conf     config.Config
+
+	queue       *queueRegistry
+	state       *stateStore
+	leases      *leaseRegistry
+	limiter     *rateLimiter
+	idempotency IdempotencyStore
+
+	// pg is a direct handle on the database behind the postgres backend, for
+	// the things the kewpie library doesn't do itself. It's nil if no queues
+	// are kept in postgres.
+	pg *sql.DB
+
+	// reloadLock stops two reloads racing each other
+	reloadLock sync.Mutex
+	// registerLock stops queues being registered or unregistered here while
+	// they're being brought into line with changes made by other processes
+	registerLock sync.Mutex
+	// reload is whether to watch for config changes
+	reload bool
+
+	// version is reported by the health check
+	version string
+
+	// ctx is done when the server's background work, like webhook delivery,
+	// should stop
+	ctx context.Context
+
+	routes routeTable
+}
+
+// newServer serves the queues in the config and restores the state saved
+// from the last run. Queues kept in the config's backend use q if there is
+// one, and the rest are connected here.
+func newServer(q Queue, o options) *server {
+	conf := o.conf
+	s := &server{
+		conf:        conf,
+		queue:       newQueueRegistry(conf.Backend),
+		state:       newStateStore(conf.StateFile),
+		leases:      newLeaseRegistry(),
+		limiter:     newRateLimiter(),
+		idempotency: newMemoryIdempotencyStore(conf.IdempotencyWindow),
+		pg:          o.db,
+		reload:      o.reload,
+		version:     o.version,
+		ctx:         o.ctx,
+	}
+	s.routes = s.routeTable()
+
+	shared := []string{}
+	others := []string{}
+	for _, name := range conf.Names() {
+		if q != nil && s.queue.kindFor(conf.Queues[name]) == conf.Backend {
+			shared = append(shared, name)
+		} else {
+			others = append(others, name)
+		}
+	}
+	s.queue.attach(q, conf.Backend, shared, conf.Queues)
+	if err := s.queue.connect(others, conf.Queues); err != nil {
+		log.Println("ERROR failed to connect to backend", conf.Backend, err)
+	}
+
+	if s.pg == nil && usesPostgres(conf) {
+		if db, err := connectPostgres(); err != nil {
+			log.Println("ERROR failed to connect to postgres, idempotency keys will only be remembered in memory", err)
+		} else {
+			s.pg = db
+		}
+	}
+	if s.pg != nil {
+		// Whether it was passed in or connected here, the database needs
+		// kewpie_http's own tables
+		if err := migratePostgres(s.pg); err != nil {
+			log.Println("ERROR failed to create tables in postgres, idempotency keys will only be remembered in memory", err)
+		} else {
+			s.idempotency = postgresIdempotencyStore{
+				db:     s.pg,
+				window: conf.IdempotencyWindow,
+			}
+			// Every process serving these queues shares the state there
+			s.state.db = s.pg
+		}
+		s.queue.db = s.pg
+	}
+	if o.idempotency != nil {
+		s.idempotency = o.idempotency
+	}
+
+	switch {
+	case s.state.db != nil && conf.StateFile != "":
+		log.Println("INFO keeping state in postgres, not in", conf.StateFile)
+	case s.state.db == nil && conf.StateFile == "":
+		log.Println("WARN KEWPIE_STATE_FILE isn't set, so paused queues and queues registered at runtime are only kept in memory and will be forgotten on restart")
+	}
+
+	if err := s.state.load(); err != nil {
+		// Don't write over state we couldn't read
+		log.Println("ERROR failed to load state, keeping state in memory until restart.", err)
+		s.state = newStateStore("")
+	}
+
+	// Bring back the queues that were registered at runtime before a restart
+	s.syncQueues()
+
+	return s
+}
+
+func usesPostgres(conf config.Config) bool {
+	for _, name := range conf.Names() {
+		if conf.BackendFor(name) == "postgres" {
+			return true
+		}
+	}
+	return conf.Backend == "postgres"
+}
+
+// pgFor is the database the named queue is kept in, or nil if it isn't kept
+// in postgres
+func (s *server) pgFor(queueName string) *sql.DB {
+	if s.queue.kindOf(queueName) != "postgres" {
+		return nil
+	}
+	return s.pg
+}
+
+// config is the config the server is currently running with. It must not be
+// modified.
+func (s *server) config() config.Config {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.conf
+}
+
+// start runs whatever works in the background, like webhook delivery and
+// watching for config changes, until the server's context is done
+func (s *server) start() {
+	s.startWebhooks(s.ctx)
+	if s.state.db != nil {
+		go s.watchState(s.ctx)
+	}
+	if s.reload {
+		s.watchConfig(s.ctx)
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.routes.serve(w, r, s.knownQueue)
+}
@@ -0,0 +1,206 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func memoryServer(t *testing.T, queues map[string]config.QueueSettings) *server {
+	names := []string{}
+	for name, settings := range queues {
+		if settings.Backend == "" || settings.Backend == "memory" {
+			names = append(names, name)
+		}
+	}
+	q := &kewpie.Kewpie{}
+	assert.Nil(t, q.Connect("memory", names))
+	return New(q, WithConfig(config.Config{
+		Backend:           "memory",
+		IdempotencyWindow: time.Hour,
+		Queues:            queues,
+	})).(*server)
+}
+
+func TestServersWithDifferentConfigs(t *testing.T) {
+	t.Parallel()
+
+	one := memoryServer(t, map[string]config.QueueSettings{
+		"shared":  {},
+		"onlyone": {},
+	})
+	two := memoryServer(t, map[string]config.QueueSettings{
+		"shared": {MaxAttempts: 2},
+	})
+
+	serve := func(s *server, method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusCreated, serve(one, "POST", "/queues/onlyone", `{"body": "one"}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(two, "POST", "/queues/onlyone", `{"body": "two"}`).Code)
+
+	queues := []queueInfo{}
+	assert.Nil(t, json.Unmarshal(serve(two, "GET", "/queues", "").Body.Bytes(), &queues))
+	assert.Len(t, queues, 1)
+	assert.Equal(t, "shared", queues[0].Name)
+	assert.Equal(t, 2, queues[0].MaxAttempts)
+
+	// A queue with the same name on each server is a different queue
+	assert.Equal(t, http.StatusCreated, serve(one, "POST", "/queues/shared", `{"body": "one"}`).Code)
+	assert.Equal(t, http.StatusNoContent, serve(two, "GET", "/queues/shared?wait=1500ms", "").Code)
+	assert.Equal(t, http.StatusOK, serve(one, "GET", "/queues/shared?wait=1500ms", "").Code)
+}
+
+func TestBackendsPerQueue(t *testing.T) {
+	t.Parallel()
+
+	s := memoryServer(t, map[string]config.QueueSettings{
+		"default":  {},
+		"explicit": {Backend: "memory"},
+	})
+
+	req, err := http.NewRequest("GET", "/health", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	report := healthReport{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, []backendHealth{{
+		Backend: "memory",
+		Healthy: true,
+		Queues:  []string{"default", "explicit"},
+	}}, report.Backends)
+	for _, stats := range report.Queues {
+		assert.Equal(t, "memory", stats.Backend)
+	}
+
+	assert.Equal(t, "memory", s.describeQueue("explicit").Backend)
+	assert.Nil(t, s.pgFor("explicit"))
+}
+
+func TestMountUnderPrefix(t *testing.T) {
+	t.Parallel()
+
+	q := &kewpie.Kewpie{}
+	assert.Nil(t, q.Connect("memory", []string{"mounted"}))
+	handler := New(q,
+		WithBackend("memory"),
+		WithQueue("mounted", config.QueueSettings{}),
+	)
+
+	seen := []string{}
+	mux := http.NewServeMux()
+	mux.Handle("/kewpie/", http.StripPrefix("/kewpie", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.URL.Path)
+		handler.ServeHTTP(w, r)
+	})))
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusCreated, serve("POST", "/kewpie/queues/mounted", `{"body": "hi"}`).Code)
+	rr := serve("GET", "/kewpie/queues/mounted?wait=1500ms", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "hi")
+	assert.Equal(t, http.StatusOK, serve("GET", "/kewpie/health", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/queues/mounted", "").Code)
+	assert.Equal(t, []string{"/queues/mounted", "/queues/mounted", "/health"}, seen)
+
+	// Links point back through the prefix
+	req, err := http.NewRequest("GET", "/queues/mounted/tasks?limit=1", nil)
+	assert.Nil(t, err)
+	req.RequestURI = "/kewpie/queues/mounted/tasks?limit=1"
+	assert.Equal(t, "/kewpie/queues/mounted/tasks?cursor=abc&limit=1", nextPage(req, "abc"))
+}
+
+func TestHealthWithUnhashableQueue(t *testing.T) {
+	t.Parallel()
+
+	// kewpie.Kewpie's methods have value receivers, so it can be passed as a
+	// value, which can't be a map key
+	q := kewpie.Kewpie{}
+	assert.Nil(t, q.Connect("memory", []string{"byvalue"}))
+	handler := New(q,
+		WithBackend("memory"),
+		WithQueue("byvalue", config.QueueSettings{}),
+	)
+
+	req, err := http.NewRequest("GET", "/health", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	report := healthReport{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, []backendHealth{{
+		Backend: "memory",
+		Healthy: true,
+		Queues:  []string{"byvalue"},
+	}}, report.Backends)
+}
+
+func TestRuntimeWebhooksStopWithContext(t *testing.T) {
+	t.Parallel()
+
+	delivered := make(chan struct{}, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer target.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &kewpie.Kewpie{}
+	assert.Nil(t, q.Connect("memory", []string{}))
+	handler := New(q,
+		WithBackend("memory"),
+		WithAdminToken("stoptoken"),
+		WithContext(ctx),
+	)
+	cancel()
+
+	// A queue registered after the server was stopped doesn't start delivering
+	req, err := http.NewRequest("PUT", "/admin/queues/stopped", strings.NewReader(`{"webhook": "`+target.URL+`"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer stoptoken")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	pubreq, err := http.NewRequest("POST", "/queues/stopped", strings.NewReader(`{"body": "undelivered"}`))
+	assert.Nil(t, err)
+	pubreq.Header.Set("Content-Type", "application/json")
+	pubrr := httptest.NewRecorder()
+	handler.ServeHTTP(pubrr, pubreq)
+	assert.Equal(t, http.StatusCreated, pubrr.Code)
+
+	select {
+	case <-delivered:
+		t.Error("a webhook was delivered after the server's context was done")
+	case <-time.After(2 * time.Second):
+	}
+}
@@ -0,0 +1,239 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/gorilla/websocket"
+)
+
+var errSocketClosed = errors.New("The socket holding the lease was closed")
+
+const defaultSocketLease = 30 * time.Second
+const maxPrefetch = 100
+
+var upgrader = websocket.Upgrader{}
+
+// socketFrame is the envelope for everything sent over a queue socket in
+// either direction.
+//
+// The server sends:
+//   {"type": "task", "id": "uuid", "lease_expires": "...", "task": {...}}
+//   {"type": "extended", "id": "uuid", "lease_expires": "..."}
+//   {"type": "error", "id": "uuid", "error": "A message about the error"}
+//
+// The client sends:
+//   {"type": "ack", "id": "uuid"}
+//   {"type": "nack", "id": "uuid", "error": "Why it failed"}
+//   {"type": "extend", "id": "uuid", "lease": "30s"}
+type socketFrame struct {
+	Type         string       `json:"type"`
+	ID           string       `json:"id,omitempty"`
+	Task         *kewpie.Task `json:"task,omitempty"`
+	Lease        string       `json:"lease,omitempty"`
+	LeaseExpires string       `json:"lease_expires,omitempty"`
+	Error        string       `json:"error,omitempty"`
+}
+
+type socket struct {
+	server    *server
+	conn      *websocket.Conn
+	queueName string
+	duration  time.Duration
+
+	writeMu sync.Mutex
+
+	sync.Mutex
+	held map[string]*lease
+}
+
+func (s *socket) send(frame socketFrame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(frame)
+}
+
+func (s *socket) lease(id string) *lease {
+	s.Lock()
+	defer s.Unlock()
+	return s.held[id]
+}
+
+// push claims tasks and sends them down the socket, keeping no more than
+// prefetch of them leased out at once
+func (s *socket) push(ctx context.Context, prefetch int) {
+	slots := make(chan struct{}, prefetch)
+
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		l := s.server.newLease(s.queueName, s.duration)
+		_, err := s.server.claim(ctx, s.queueName, func(task kewpie.Task) (bool, error) {
+			defer func() {
+				s.Lock()
+				delete(s.held, task.ID)
+				s.Unlock()
+				<-slots
+			}()
+			return l.hold(task)
+		})
+		if err == errQueuePaused {
+			s.send(socketFrame{Type: "error", Error: err.Error()})
+			s.conn.Close()
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("ERROR popping job for socket", s.queueName, err)
+				s.send(socketFrame{Type: "error", Error: "Error popping job from queue"})
+				s.conn.Close()
+			}
+			return
+		}
+		<-l.ready
+
+		s.Lock()
+		s.held[l.Task.ID] = l
+		s.Unlock()
+
+		task := l.Task
+		if err := s.send(socketFrame{
+			Type:         "task",
+			ID:           task.ID,
+			Task:         &task,
+			LeaseExpires: s.server.leases.expires(l).Format(time.RFC3339),
+		}); err != nil {
+			log.Println("ERROR writing task to socket", s.queueName, err)
+			s.server.leases.settle(l, leaseResult{requeue: true, err: err})
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// receive applies a frame from the client to the lease it refers to
+func (s *socket) receive(frame socketFrame) error {
+	l := s.lease(frame.ID)
+	if l == nil {
+		return fmt.Errorf("No active lease for task %s. It may have expired", frame.ID)
+	}
+
+	switch frame.Type {
+	case "ack", "nack":
+		res := leaseResult{}
+		if frame.Type == "nack" {
+			res = nack(frame.Error)
+		}
+		if !s.server.leases.settle(l, res) {
+			return fmt.Errorf("No active lease for task %s. It may have expired", frame.ID)
+		}
+	case "extend":
+		duration, err := time.ParseDuration(frame.Lease)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Lease is not a valid duration, eg: 30s")
+		}
+		expires, ok := s.server.leases.extend(l, duration)
+		if !ok {
+			return fmt.Errorf("No active lease for task %s. It may have expired", frame.ID)
+		}
+		return s.send(socketFrame{
+			Type:         "extended",
+			ID:           frame.ID,
+			LeaseExpires: expires.Format(time.RFC3339),
+		})
+	default:
+		return fmt.Errorf("Unknown frame type %q. Expected ack, nack or extend", frame.Type)
+	}
+	return nil
+}
+
+func (s *server) socketHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	duration, err := leaseFor(r)
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if duration == 0 {
+		duration = defaultSocketLease
+	}
+
+	prefetch := 1
+	if param := r.URL.Query().Get("prefetch"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed < 1 || parsed > maxPrefetch {
+			errRes(w, r, http.StatusBadRequest, fmt.Sprintf("Prefetch must be a number between 1 and %d", maxPrefetch), err)
+			return
+		}
+		prefetch = parsed
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already told the client what went wrong
+		log.Println("WARN failed to upgrade socket", queueName, err)
+		return
+	}
+	defer conn.Close()
+
+	sock := &socket{
+		server:    s,
+		conn:      conn,
+		queueName: queueName,
+		duration:  duration,
+		held:      map[string]*lease{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sock.push(ctx, prefetch)
+	}()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok && ctx.Err() == nil {
+				log.Println("WARN reading from socket", queueName, err)
+			}
+			break
+		}
+		frame := socketFrame{}
+		if err := json.Unmarshal(message, &frame); err != nil {
+			sock.send(socketFrame{Type: "error", Error: "Error decoding frame"})
+			continue
+		}
+		if err := sock.receive(frame); err != nil {
+			sock.send(socketFrame{Type: "error", ID: frame.ID, Error: err.Error()})
+		}
+	}
+
+	cancel()
+	wg.Wait()
+
+	// Anything still held goes back on the queue
+	sock.Lock()
+	held := []*lease{}
+	for _, l := range sock.held {
+		held = append(held, l)
+	}
+	sock.Unlock()
+	for _, l := range held {
+		s.leases.settle(l, leaseResult{requeue: true, err: errSocketClosed})
+	}
+}
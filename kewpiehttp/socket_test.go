@@ -0,0 +1,67 @@
+package kewpiehttp
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "sockettest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestSocket(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(Router()))
+	defer server.Close()
+
+	fixture := kewpie.Task{
+		Body:         `{"hi": "` + uuid.NewV4().String() + `"}`,
+		NoExpBackoff: true,
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "sockettest", &fixture))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/queues/sockettest/socket?lease=30s", nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	frame := socketFrame{}
+	assert.Nil(t, conn.ReadJSON(&frame))
+	assert.Equal(t, "task", frame.Type)
+	assert.Equal(t, fixture.Body, frame.Task.Body)
+	assert.NotEmpty(t, frame.LeaseExpires)
+
+	assert.Nil(t, conn.WriteJSON(socketFrame{Type: "extend", ID: frame.ID, Lease: "1m"}))
+
+	extended := socketFrame{}
+	assert.Nil(t, conn.ReadJSON(&extended))
+	assert.Equal(t, "extended", extended.Type)
+	assert.Equal(t, frame.ID, extended.ID)
+
+	assert.Nil(t, conn.WriteJSON(socketFrame{Type: "nack", ID: frame.ID, Error: "try again"}))
+
+	redelivered := socketFrame{}
+	assert.Nil(t, conn.ReadJSON(&redelivered))
+	assert.Equal(t, "task", redelivered.Type)
+	assert.Equal(t, fixture.Body, redelivered.Task.Body)
+	assert.Equal(t, 1, redelivered.Task.Attempts)
+
+	assert.Nil(t, conn.WriteJSON(socketFrame{Type: "ack", ID: redelivered.ID}))
+	assert.Nil(t, conn.WriteJSON(socketFrame{Type: "ack", ID: redelivered.ID}))
+
+	unknown := socketFrame{}
+	assert.Nil(t, conn.ReadJSON(&unknown))
+	assert.Equal(t, "error", unknown.Type)
+	assert.Equal(t, redelivered.ID, unknown.ID)
+}
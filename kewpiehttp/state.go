@@ -0,0 +1,310 @@
+package kewpiehttp
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/paidright/kewpie_http/config"
+)
+
+// serverState is what kewpie_http remembers across restarts
+type serverState struct {
+	Paused map[string]time.Time            `json:"paused"`
+	Queues map[string]config.QueueSettings `json:"queues"`
+}
+
+// statePoll is how often state kept in postgres is read again, to pick up
+// changes made by other processes
+const statePoll = 5 * time.Second
+
+// stateStore keeps the server state in postgres if it has a db, or in a JSON
+// file if it has a path, and lets anyone waiting on it know when it changes
+type stateStore struct {
+	sync.Mutex
+	path string
+	// db is shared by every process serving the same queues, unlike the file
+	db      *sql.DB
+	state   serverState
+	changed chan struct{}
+}
+
+func newStateStore(path string) *stateStore {
+	return &stateStore{
+		path: path,
+		state: serverState{
+			Paused: map[string]time.Time{},
+			Queues: map[string]config.QueueSettings{},
+		},
+		changed: make(chan struct{}),
+	}
+}
+
+func decodeState(data []byte) (serverState, error) {
+	decoded := serverState{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return decoded, err
+	}
+	if decoded.Paused == nil {
+		decoded.Paused = map[string]time.Time{}
+	}
+	if decoded.Queues == nil {
+		decoded.Queues = map[string]config.QueueSettings{}
+	}
+	return decoded, nil
+}
+
+// load reads the saved state. State that hasn't been saved yet is empty.
+// Anyone waiting on the state is only told if it has changed.
+func (store *stateStore) load() error {
+	data, err := store.read()
+	if err != nil || data == nil {
+		return err
+	}
+
+	loaded, err := decodeState(data)
+	if err != nil {
+		return err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if current, err := json.Marshal(store.state); err == nil {
+		if normalised, err := json.Marshal(loaded); err == nil && bytes.Equal(current, normalised) {
+			return nil
+		}
+	}
+	store.state = loaded
+	close(store.changed)
+	store.changed = make(chan struct{})
+	return nil
+}
+
+// read is the saved state as JSON, or nil if nothing has been saved yet
+func (store *stateStore) read() ([]byte, error) {
+	if store.db != nil {
+		data := []byte{}
+		err := store.db.QueryRow(`SELECT state FROM kewpie_http_state WHERE id = 1`).Scan(&data)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return data, err
+	}
+
+	if store.path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// update applies fn to a copy of the state and saves it. The copy only
+// replaces the current state once it has been saved, so readers never see a
+// change that didn't make it to disk.
+func (store *stateStore) update(fn func(*serverState)) error {
+	store.Lock()
+	defer store.Unlock()
+
+	next := serverState{}
+	if store.db != nil {
+		updated, err := store.updateDB(fn)
+		if err != nil {
+			return err
+		}
+		next = updated
+	} else {
+		current, err := json.Marshal(store.state)
+		if err != nil {
+			return err
+		}
+		if next, err = decodeState(current); err != nil {
+			return err
+		}
+
+		fn(&next)
+
+		if err := store.save(next); err != nil {
+			return err
+		}
+	}
+
+	store.state = next
+	close(store.changed)
+	store.changed = make(chan struct{})
+	return nil
+}
+
+// updateDB applies fn to the state saved in postgres rather than the copy in
+// memory, holding the row while it does so that changes made by other
+// processes at the same time aren't lost
+func (store *stateStore) updateDB(fn func(*serverState)) (serverState, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return serverState{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO kewpie_http_state (id, state) VALUES (1, '{}') ON CONFLICT (id) DO NOTHING`); err != nil {
+		return serverState{}, err
+	}
+	data := []byte{}
+	if err := tx.QueryRow(`SELECT state FROM kewpie_http_state WHERE id = 1 FOR UPDATE`).Scan(&data); err != nil {
+		return serverState{}, err
+	}
+	next, err := decodeState(data)
+	if err != nil {
+		return next, err
+	}
+
+	fn(&next)
+
+	if data, err = json.Marshal(next); err != nil {
+		return next, err
+	}
+	if _, err := tx.Exec(`UPDATE kewpie_http_state SET state = $1 WHERE id = 1`, data); err != nil {
+		return next, err
+	}
+	return next, tx.Commit()
+}
+
+// save writes the state to a temporary file and moves it into place, so a
+// crash part way through doesn't leave a half written file behind
+func (store *stateStore) save(s serverState) error {
+	if store.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), store.path)
+}
+
+// watch returns the current state along with a channel that is closed the
+// next time it changes. The state must not be modified.
+func (store *stateStore) watch() (serverState, <-chan struct{}) {
+	store.Lock()
+	defer store.Unlock()
+	return store.state, store.changed
+}
+
+// pausedAt reports whether the named queue is paused and since when
+func (store *stateStore) pausedAt(queueName string) (time.Time, bool) {
+	current, _ := store.watch()
+	at, ok := current.Paused[queueName]
+	return at, ok
+}
+
+func (store *stateStore) paused(queueName string) bool {
+	_, ok := store.pausedAt(queueName)
+	return ok
+}
+
+func (store *stateStore) pause(queueName string) error {
+	return store.update(func(s *serverState) {
+		if _, ok := s.Paused[queueName]; !ok {
+			s.Paused[queueName] = time.Now()
+		}
+	})
+}
+
+func (store *stateStore) resume(queueName string) error {
+	return store.update(func(s *serverState) {
+		delete(s.Paused, queueName)
+	})
+}
+
+// waitResumed blocks until the named queue isn't paused
+func (store *stateStore) waitResumed(ctx context.Context, queueName string) error {
+	for {
+		current, changed := store.watch()
+		if _, ok := current.Paused[queueName]; !ok {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// untilPaused returns a context that is cancelled when the named queue is
+// paused
+func (store *stateStore) untilPaused(ctx context.Context, queueName string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		for {
+			current, changed := store.watch()
+			if _, ok := current.Paused[queueName]; ok {
+				return
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// watchState reads the state again every statePoll until ctx is done, so that
+// queues paused or registered through another process are here too
+func (s *server) watchState(ctx context.Context) {
+	ticker := time.NewTicker(statePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.refreshState(ctx)
+	}
+}
+
+func (s *server) refreshState(ctx context.Context) {
+	s.registerLock.Lock()
+	defer s.registerLock.Unlock()
+
+	_, changed := s.state.watch()
+	if err := s.state.load(); err != nil {
+		log.Println("ERROR failed to read state", err)
+		return
+	}
+	select {
+	case <-changed:
+		for _, name := range s.syncQueues() {
+			s.startWebhook(ctx, name)
+		}
+	default:
+	}
+}
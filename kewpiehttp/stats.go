@@ -0,0 +1,143 @@
+package kewpiehttp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// queueStats is a snapshot of a queue's backlog. Fields the backend can't
+// answer are null and listed in Unsupported.
+type queueStats struct {
+	Queue          string   `json:"queue"`
+	Backend        string   `json:"backend"`
+	Ready          *int     `json:"ready"`
+	Delayed        *int     `json:"delayed"`
+	InFlight       *int     `json:"in_flight"`
+	OldestReadyAge *float64 `json:"oldest_ready_age_seconds"`
+	Unsupported    []string `json:"unsupported,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+type jsonAPIStatsData struct {
+	Type       string     `json:"type"`
+	ID         string     `json:"id"`
+	Attributes queueStats `json:"attributes"`
+}
+
+type jsonAPIStatsPayload struct {
+	Errors []map[string]string `json:"errors"`
+	Data   jsonAPIStatsData    `json:"data"`
+	Meta   map[string]string   `json:"meta"`
+}
+
+func (s *server) statsFor(ctx context.Context, queueName string) (queueStats, error) {
+	inFlight := s.leases.count(queueName)
+
+	stats := queueStats{
+		Queue:    queueName,
+		Backend:  s.queue.kindOf(queueName),
+		InFlight: &inFlight,
+	}
+
+	pg := s.pgFor(queueName)
+	if pg == nil {
+		// Only postgres can be looked into without consuming anything
+		stats.Unsupported = []string{"ready", "delayed", "oldest_ready_age_seconds"}
+		return stats, nil
+	}
+
+	var ready, delayed int
+	var oldest sql.NullFloat64
+	if err := pg.QueryRowContext(ctx, `SELECT
+COUNT(*) FILTER (WHERE run_at < NOW()),
+COUNT(*) FILTER (WHERE run_at >= NOW()),
+EXTRACT(EPOCH FROM NOW() - MIN(created_at) FILTER (WHERE run_at < NOW()))
+FROM `+tableFor(queueName)).Scan(&ready, &delayed, &oldest); err != nil {
+		return stats, err
+	}
+
+	stats.Ready = &ready
+	stats.Delayed = &delayed
+	if oldest.Valid {
+		stats.OldestReadyAge = &oldest.Float64
+	} else {
+		none := 0.0
+		stats.OldestReadyAge = &none
+	}
+
+	return stats, nil
+}
+
+func (s *server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	stats, err := s.statsFor(r.Context(), queueName)
+	if err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error reading stats for queue", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		payload := jsonAPIStatsPayload{
+			Data: jsonAPIStatsData{
+				Type:       "queue_stats",
+				ID:         queueName,
+				Attributes: stats,
+			},
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+	}
+}
+
+// healthReport is what the health check returns to clients that ask for JSON
+type healthReport struct {
+	Version  string          `json:"version"`
+	Backend  string          `json:"backend"`
+	Backends []backendHealth `json:"backends"`
+	Queues   []queueStats    `json:"queues"`
+}
+
+type jsonAPIHealthData struct {
+	Type       string       `json:"type"`
+	ID         string       `json:"id"`
+	Attributes healthReport `json:"attributes"`
+}
+
+type jsonAPIHealthPayload struct {
+	Errors []map[string]string `json:"errors"`
+	Data   jsonAPIHealthData   `json:"data"`
+	Meta   map[string]string   `json:"meta"`
+}
+
+func (s *server) reportHealth(ctx context.Context, backends []backendHealth) healthReport {
+	report := healthReport{
+		Version:  s.version,
+		Backend:  s.config().Backend,
+		Backends: backends,
+		Queues:   []queueStats{},
+	}
+
+	for _, name := range s.queue.names() {
+		stats, err := s.statsFor(ctx, name)
+		if err != nil {
+			// A queue we can't count shouldn't fail the health check
+			log.Println("WARN failed to read stats for health check", name, err)
+			stats.Error = "Error reading stats for queue"
+		}
+		report.Queues = append(report.Queues, stats)
+	}
+
+	return report
+}
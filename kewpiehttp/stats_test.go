@@ -0,0 +1,95 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "statstest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+
+	for _, delay := range []time.Duration{0, 0, time.Hour} {
+		fixture := kewpie.Task{
+			Body:  `{"hi": "stats"}`,
+			Delay: delay,
+		}
+		assert.Nil(t, testServer.queue.Publish(ctx, "statstest", &fixture))
+	}
+
+	subreq, err := http.NewRequest("GET", "/queues/statstest?lease=30s&wait=5s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+	assert.Equal(t, http.StatusOK, subrr.Code)
+
+	req, err := http.NewRequest("GET", "/queues/statstest/stats", nil)
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	res := queueStats{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, "statstest", res.Queue)
+	if assert.NotNil(t, res.InFlight) {
+		assert.Equal(t, 1, *res.InFlight)
+	}
+
+	if testServer.pg == nil {
+		assert.Nil(t, res.Ready)
+		assert.Nil(t, res.Delayed)
+		assert.Nil(t, res.OldestReadyAge)
+		assert.Contains(t, res.Unsupported, "ready")
+		assert.Contains(t, res.Unsupported, "delayed")
+		return
+	}
+
+	assert.Empty(t, res.Unsupported)
+	if assert.NotNil(t, res.Ready) && assert.NotNil(t, res.Delayed) {
+		assert.Equal(t, 1, *res.Ready)
+		assert.Equal(t, 1, *res.Delayed)
+	}
+	assert.NotNil(t, res.OldestReadyAge)
+}
+
+func TestHealthJSON(t *testing.T) {
+	t.Parallel()
+
+	req, err := http.NewRequest("GET", "/health", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/json")
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	res := healthReport{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, testVersion, res.Version)
+	assert.NotEmpty(t, res.Queues)
+
+	plainreq, err := http.NewRequest("GET", "/healthz", nil)
+	assert.Nil(t, err)
+
+	plainrr := httptest.NewRecorder()
+	Router()(plainrr, plainreq)
+
+	assert.Equal(t, http.StatusOK, plainrr.Code)
+	assert.Equal(t, testVersion, plainrr.Body.String())
+}
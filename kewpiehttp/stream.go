@@ -0,0 +1,106 @@
+package kewpiehttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+)
+
+// heartbeatInterval is how often an idle stream gets a comment written to it,
+// so that proxies don't decide the connection is dead
+const heartbeatInterval = 15 * time.Second
+
+func (s *server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errRes(w, r, http.StatusInternalServerError, "Streaming is not supported by this connection", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var mu sync.Mutex
+	write := func(event string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := io.WriteString(w, event); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	// The heartbeat has to be finished with the ResponseWriter before we return
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := write(": heartbeat\n\n"); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+
+	for {
+		// Only mark the task complete once it has made it onto the wire
+		written := make(chan error, 1)
+		task, err := s.claim(r.Context(), queueName, func(kewpie.Task) (bool, error) {
+			if err := <-written; err != nil {
+				return true, err
+			}
+			return false, nil
+		})
+		if err == errQueuePaused {
+			write(fmt.Sprintf("event: error\ndata: %s\n\n", err.Error()))
+			return
+		}
+		if err != nil {
+			if r.Context().Err() == nil {
+				log.Println("ERROR streaming from queue", queueName, err)
+				write(fmt.Sprintf("event: error\ndata: %s\n\n", "Error popping job from queue"))
+			}
+			return
+		}
+
+		event, err := formatEvent(task)
+		if err == nil {
+			err = write(event)
+		}
+		written <- err
+		if err != nil {
+			log.Println("ERROR writing task to stream", queueName, err)
+			return
+		}
+	}
+}
+
+func formatEvent(task kewpie.Task) (string, error) {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("id: %s\nevent: task\ndata: %s\n\n", task.ID, data), nil
+}
@@ -0,0 +1,70 @@
+package kewpiehttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "streamtest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(Router()))
+	defer server.Close()
+
+	fixtures := []kewpie.Task{}
+	for i := 0; i < 2; i++ {
+		fixture := kewpie.Task{
+			Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+		}
+		assert.Nil(t, testServer.queue.Publish(context.Background(), "streamtest", &fixture))
+		fixtures = append(fixtures, fixture)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", server.URL+"/queues/streamtest/stream", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	assert.Nil(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(res.Body)
+	for _, fixture := range fixtures {
+		id := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "id: ") {
+				id = strings.TrimPrefix(line, "id: ")
+			}
+			if strings.HasPrefix(line, "data: ") {
+				task := kewpie.Task{}
+				assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &task))
+				assert.Equal(t, fixture.Body, task.Body)
+				assert.Equal(t, task.ID, id)
+				break
+			}
+		}
+	}
+}
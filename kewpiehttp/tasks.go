@@ -0,0 +1,477 @@
+package kewpiehttp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	uuid "github.com/satori/go.uuid"
+)
+
+const defaultPeek = 20
+const maxPeek = 500
+
+const tagParamPrefix = "tag."
+
+// taskColumns are the columns of a postgres queue table that make up a task
+const taskColumns = "id, body, delay, run_at, no_exp_backoff, attempts, tags"
+
+var errInvalidCursor = errors.New("Cursor is not valid. Use the one from the previous page's next link")
+
+// taskFilter narrows down the tasks in a queue without consuming them
+type taskFilter struct {
+	Tags      map[string]string
+	Matching  string
+	RunAfter  time.Time
+	RunBefore time.Time
+}
+
+// filterFrom reads a filter from request params, eg:
+// ?tag.customer=123&matching=foo&run_after=2019-08-01T00:00:00Z
+func filterFrom(values url.Values) (taskFilter, error) {
+	filter := taskFilter{
+		Tags:     map[string]string{},
+		Matching: values.Get("matching"),
+	}
+
+	for key, vals := range values {
+		if strings.HasPrefix(key, tagParamPrefix) && len(vals) > 0 {
+			filter.Tags[strings.TrimPrefix(key, tagParamPrefix)] = vals[0]
+		}
+	}
+
+	for param, dest := range map[string]*time.Time{
+		"run_after":  &filter.RunAfter,
+		"run_before": &filter.RunBefore,
+	} {
+		if values.Get(param) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, values.Get(param))
+		if err != nil {
+			return filter, fmt.Errorf("%s is not a valid RFC3339 time, eg: 2019-08-01T00:00:00Z", param)
+		}
+		*dest = parsed
+	}
+
+	return filter, nil
+}
+
+// where builds the SQL conditions for the filter, numbering its placeholders
+// on from the args it is given
+func (filter taskFilter) where(args []interface{}) ([]string, []interface{}) {
+	conditions := []string{}
+
+	if len(filter.Tags) > 0 {
+		tags, _ := json.Marshal(filter.Tags)
+		args = append(args, string(tags))
+		conditions = append(conditions, "tags @> $"+strconv.Itoa(len(args))+"::jsonb")
+	}
+	if filter.Matching != "" {
+		args = append(args, filter.Matching)
+		conditions = append(conditions, "body LIKE '%' || $"+strconv.Itoa(len(args))+" || '%'")
+	}
+	if !filter.RunAfter.IsZero() {
+		args = append(args, filter.RunAfter)
+		conditions = append(conditions, "run_at >= $"+strconv.Itoa(len(args)))
+	}
+	if !filter.RunBefore.IsZero() {
+		args = append(args, filter.RunBefore)
+		conditions = append(conditions, "run_at < $"+strconv.Itoa(len(args)))
+	}
+
+	return conditions, args
+}
+
+// A cursor marks the last task on a page, so the next page carries on after it
+// even if tasks ahead of it have been consumed in the meantime
+func encodeCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.Format(time.RFC3339Nano) + " " + id))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	parts := strings.SplitN(string(decoded), " ", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", errInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	return createdAt, parts[1], nil
+}
+
+type jsonAPIPagePayload struct {
+	Errors []map[string]string `json:"errors"`
+	Data   []jsonAPIData       `json:"data"`
+	Links  map[string]string   `json:"links"`
+	Meta   map[string]string   `json:"meta"`
+}
+
+func (s *server) peekHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+
+	pg := s.pgFor(queueName)
+	if pg == nil {
+		errRes(w, r, http.StatusNotImplemented, "Listing tasks is only supported on the postgres backend", nil)
+		return
+	}
+
+	limit := defaultPeek
+	if param := r.URL.Query().Get("limit"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed < 1 || parsed > maxPeek {
+			errRes(w, r, http.StatusBadRequest, fmt.Sprintf("Limit must be a number between 1 and %d", maxPeek), err)
+			return
+		}
+		limit = parsed
+	}
+
+	filter, err := filterFrom(r.URL.Query())
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	conditions, args := filter.where(nil)
+
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		createdAt, id, err := decodeCursor(cursor)
+		if err != nil {
+			errRes(w, r, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		args = append(args, createdAt, id)
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) > ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	query := `SELECT ` + taskColumns + `, created_at FROM ` + tableFor(queueName)
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	// Fetch one more than was asked for to find out if there's another page
+	query += ` ORDER BY created_at, id LIMIT ` + strconv.Itoa(limit+1)
+
+	rows, err := pg.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error listing tasks", err)
+		return
+	}
+	defer rows.Close()
+
+	tasks := []kewpie.Task{}
+	next := ""
+	var lastCreated time.Time
+	for rows.Next() {
+		if len(tasks) == limit {
+			next = nextPage(r, encodeCursor(lastCreated, tasks[len(tasks)-1].ID))
+			break
+		}
+		task := kewpie.Task{}
+		if err := rows.Scan(&task.ID, &task.Body, &task.Delay, &task.RunAt, &task.NoExpBackoff, &task.Attempts, &task.Tags, &lastCreated); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error listing tasks", err)
+			return
+		}
+		tasks = append(tasks, task)
+	}
+	if err := rows.Err(); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error listing tasks", err)
+		return
+	}
+
+	sendPage(w, r, tasks, next)
+}
+
+// nextPage is the URL of the request with its cursor moved on. It keeps the
+// path the client asked for, so it still works when the server is mounted
+// under a prefix.
+func nextPage(r *http.Request, cursor string) string {
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	next := url.URL{
+		Path:     r.URL.Path,
+		RawQuery: query.Encode(),
+	}
+	if requested, err := url.ParseRequestURI(r.RequestURI); err == nil && requested.Path != "" {
+		next.Path = requested.Path
+	}
+	return next.String()
+}
+
+// sendPage sends a page of tasks with a link to the next one, if there is one.
+// JSON-API clients get it in links.next, and plain clients in a Link header.
+func sendPage(w http.ResponseWriter, r *http.Request, tasks []kewpie.Task, next string) {
+	if r.Header.Get("Accept") == "application/vnd.api+json" {
+		w.Header().Set("Content-Type", "application/json")
+		payload := jsonAPIPagePayload{
+			Data:  []jsonAPIData{},
+			Links: map[string]string{},
+		}
+		for _, task := range tasks {
+			payload.Data = append(payload.Data, jsonAPIData{
+				Type:       "jobs",
+				ID:         task.ID,
+				Attributes: task,
+			})
+		}
+		if next != "" {
+			payload.Links["next"] = next
+		}
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			errRes(w, r, http.StatusInternalServerError, "Error encoding response", err)
+		}
+		return
+	}
+
+	if next != "" {
+		w.Header().Set("Link", "<"+next+`>; rel="next"`)
+	}
+	sendManyPayload(w, r, tasks)
+}
+
+var errTaskNotFound = errors.New("There is no task with that ID. It may have already been consumed")
+var errTaskLeased = errors.New("That task is leased out. Ack or nack it through its lease instead")
+
+// taskPatch holds the fields of a task that can be changed while it waits on
+// the queue. Fields that are left out are left alone.
+type taskPatch struct {
+	Body  *string        `json:"body"`
+	RunAt *time.Time     `json:"run_at"`
+	Delay *time.Duration `json:"delay"`
+	Tags  *kewpie.Tags   `json:"tags"`
+}
+
+type jsonAPIPatchPayload struct {
+	Data struct {
+		Attributes taskPatch `json:"attributes"`
+	} `json:"data"`
+}
+
+func (patch taskPatch) validate() error {
+	if patch.Body != nil && *patch.Body == "" {
+		return errors.New("A task body can't be removed")
+	}
+	if patch.Delay != nil && *patch.Delay < 0 {
+		return errors.New("Delay can't be negative")
+	}
+	return nil
+}
+
+func (patch taskPatch) apply(task *kewpie.Task) {
+	if patch.Body != nil {
+		task.Body = *patch.Body
+	}
+	if patch.Tags != nil {
+		task.Tags = *patch.Tags
+	}
+	if patch.RunAt != nil {
+		task.RunAt = *patch.RunAt
+	}
+	// Delay overrides RunAt, as it does on publish
+	if patch.Delay != nil {
+		task.RunAt = time.Now().Add(*patch.Delay)
+	}
+	task.Delay = time.Until(task.RunAt)
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// validTaskID is whether id could be a task's ID. Postgres refuses to compare
+// anything else with the id column, rather than finding nothing.
+func validTaskID(id string) bool {
+	_, err := uuid.FromString(id)
+	return err == nil
+}
+
+// findTask looks up a task waiting on the named queue. lock holds the row
+// until the transaction it was found in ends, which also keeps it from being
+// popped in the meantime.
+func findTask(ctx context.Context, db querier, queueName, id string, lock bool) (kewpie.Task, error) {
+	query := `SELECT ` + taskColumns + ` FROM ` + tableFor(queueName) + ` WHERE id = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+
+	task := kewpie.Task{}
+	if err := db.QueryRowContext(ctx, query, id).Scan(&task.ID, &task.Body, &task.Delay, &task.RunAt, &task.NoExpBackoff, &task.Attempts, &task.Tags); err != nil {
+		if err == sql.ErrNoRows {
+			return task, errTaskNotFound
+		}
+		return task, err
+	}
+	return task, nil
+}
+
+// taskErrRes tells the client why a task couldn't be found or changed
+func taskErrRes(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errTaskNotFound:
+		errRes(w, r, http.StatusNotFound, err.Error(), err)
+	case errTaskLeased:
+		errRes(w, r, http.StatusConflict, err.Error(), err)
+	default:
+		errRes(w, r, http.StatusInternalServerError, "Error handling task", err)
+	}
+}
+
+func (s *server) getTaskHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+	id := pathParam(r, "id")
+	if !validTaskID(id) {
+		taskErrRes(w, r, errTaskNotFound)
+		return
+	}
+
+	// A leased task is no longer in the backend, but it's still around
+	if l := s.leases.get(queueName, id); l != nil {
+		sendPayloadMeta(w, r, l.Task, map[string]string{
+			"lease_expires": s.leases.expires(l).Format(time.RFC3339),
+		})
+		return
+	}
+
+	pg := s.pgFor(queueName)
+	if pg == nil {
+		errRes(w, r, http.StatusNotImplemented, "Fetching tasks is only supported on the postgres backend", nil)
+		return
+	}
+
+	task, err := findTask(r.Context(), pg, queueName, id, false)
+	if err != nil {
+		taskErrRes(w, r, err)
+		return
+	}
+
+	sendPayload(w, r, task)
+}
+
+func (s *server) deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+	id := pathParam(r, "id")
+	if !validTaskID(id) {
+		taskErrRes(w, r, errTaskNotFound)
+		return
+	}
+
+	if s.leases.get(queueName, id) != nil {
+		taskErrRes(w, r, errTaskLeased)
+		return
+	}
+
+	pg := s.pgFor(queueName)
+	if pg == nil {
+		errRes(w, r, http.StatusNotImplemented, "Deleting tasks is only supported on the postgres backend", nil)
+		return
+	}
+
+	task := kewpie.Task{}
+	if err := pg.QueryRowContext(r.Context(), `DELETE FROM `+tableFor(queueName)+` WHERE id = $1 RETURNING `+taskColumns, id).Scan(&task.ID, &task.Body, &task.Delay, &task.RunAt, &task.NoExpBackoff, &task.Attempts, &task.Tags); err != nil {
+		if err == sql.ErrNoRows {
+			err = errTaskNotFound
+		}
+		taskErrRes(w, r, err)
+		return
+	}
+
+	sendPayload(w, r, task)
+}
+
+func (s *server) patchTaskHandler(w http.ResponseWriter, r *http.Request) {
+	queueName := queueName(r)
+	id := pathParam(r, "id")
+	if !validTaskID(id) {
+		taskErrRes(w, r, errTaskNotFound)
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, "Error receiving payload", err)
+		return
+	}
+
+	patch := taskPatch{}
+	if r.Header.Get("Content-Type") == "application/vnd.api+json" {
+		payload := jsonAPIPatchPayload{}
+		err = json.Unmarshal(bytes, &payload)
+		patch = payload.Data.Attributes
+	} else {
+		err = json.Unmarshal(bytes, &patch)
+	}
+	if err != nil {
+		errRes(w, r, http.StatusBadRequest, "Error decoding payload", err)
+		return
+	}
+
+	if err := patch.validate(); err != nil {
+		errRes(w, r, http.StatusUnprocessableEntity, err.Error(), err)
+		return
+	}
+	if patch.Body != nil {
+		// A changed body has to match the schema, as it did on publish
+		if err := s.checkSchema(queueName, *patch.Body); err != nil {
+			errRes(w, r, http.StatusUnprocessableEntity, err.Error(), err)
+			return
+		}
+	}
+
+	if s.leases.get(queueName, id) != nil {
+		taskErrRes(w, r, errTaskLeased)
+		return
+	}
+
+	pg := s.pgFor(queueName)
+	if pg == nil {
+		errRes(w, r, http.StatusNotImplemented, "Changing tasks is only supported on the postgres backend", nil)
+		return
+	}
+
+	tx, err := pg.BeginTx(r.Context(), nil)
+	if err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error handling task", err)
+		return
+	}
+	defer tx.Rollback()
+
+	task, err := findTask(r.Context(), tx, queueName, id, true)
+	if err != nil {
+		taskErrRes(w, r, err)
+		return
+	}
+
+	patch.apply(&task)
+
+	if _, err := tx.ExecContext(r.Context(), `UPDATE `+tableFor(queueName)+` SET body = $1, delay = $2, run_at = $3, tags = $4 WHERE id = $5`,
+		task.Body,
+		task.Delay,
+		task.RunAt,
+		task.Tags,
+		task.ID,
+	); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error handling task", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		errRes(w, r, http.StatusInternalServerError, "Error handling task", err)
+		return
+	}
+
+	sendPayload(w, r, task)
+}
@@ -0,0 +1,254 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "peektest"); err != nil {
+		log.Fatal(err)
+	}
+	if err := testServer.queue.Purge(context.Background(), "tasktest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestFilterFrom(t *testing.T) {
+	filter, err := filterFrom(url.Values{
+		"tag.customer": {"123"},
+		"tag.kind":     {"invoice"},
+		"matching":     {"foo"},
+		"run_after":    {"2019-08-01T00:00:00Z"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"customer": "123", "kind": "invoice"}, filter.Tags)
+	assert.Equal(t, "foo", filter.Matching)
+	assert.Equal(t, 2019, filter.RunAfter.Year())
+	assert.True(t, filter.RunBefore.IsZero())
+
+	conditions, args := filter.where([]interface{}{"first"})
+	assert.Equal(t, []string{
+		"tags @> $2::jsonb",
+		"body LIKE '%' || $3 || '%'",
+		"run_at >= $4",
+	}, conditions)
+	assert.Equal(t, 4, len(args))
+
+	_, err = filterFrom(url.Values{"run_before": {"tomorrow"}})
+	assert.NotNil(t, err)
+}
+
+func TestCursor(t *testing.T) {
+	createdAt := time.Now().UTC()
+	id := uuid.NewV4().String()
+
+	decodedAt, decodedID, err := decodeCursor(encodeCursor(createdAt, id))
+	assert.Nil(t, err)
+	assert.True(t, createdAt.Equal(decodedAt))
+	assert.Equal(t, id, decodedID)
+
+	_, _, err = decodeCursor("not a cursor")
+	assert.Equal(t, errInvalidCursor, err)
+}
+
+func TestPeek(t *testing.T) {
+	if testServer.pg == nil {
+		req, err := http.NewRequest("GET", "/queues/peektest/tasks", nil)
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusNotImplemented, rr.Code)
+		t.Skip("Listing tasks needs the postgres backend")
+	}
+
+	ctx := context.Background()
+	customer := uuid.NewV4().String()
+	for i := 0; i < 3; i++ {
+		fixture := kewpie.Task{
+			Body: `{"hi": "peek"}`,
+			Tags: kewpie.Tags{"customer": customer},
+		}
+		assert.Nil(t, testServer.queue.Publish(ctx, "peektest", &fixture))
+	}
+
+	req, err := http.NewRequest("GET", "/queues/peektest/tasks?limit=2&tag.customer="+customer, nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/vnd.api+json")
+
+	rr := httptest.NewRecorder()
+	Router()(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	res := jsonAPIPagePayload{}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	assert.Equal(t, 2, len(res.Data))
+	assert.NotEmpty(t, res.Links["next"])
+
+	nextreq, err := http.NewRequest("GET", res.Links["next"], nil)
+	assert.Nil(t, err)
+
+	nextrr := httptest.NewRecorder()
+	Router()(nextrr, nextreq)
+
+	assert.Equal(t, http.StatusOK, nextrr.Code)
+	assert.Empty(t, nextrr.Header().Get("Link"))
+	next := []kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(nextrr.Body.Bytes(), &next))
+	assert.Equal(t, 1, len(next))
+
+	// Nothing was consumed
+	again := httptest.NewRecorder()
+	Router()(again, req)
+	assert.Nil(t, json.Unmarshal(again.Body.Bytes(), &res))
+	assert.Equal(t, 2, len(res.Data))
+}
+
+func TestTaskPatch(t *testing.T) {
+	task := kewpie.Task{
+		Body:  "before",
+		RunAt: time.Now(),
+		Tags:  kewpie.Tags{"kind": "reminder"},
+	}
+
+	patch := taskPatch{}
+	assert.Nil(t, json.Unmarshal([]byte(`{"body": "after", "delay": 60000000000}`), &patch))
+	assert.Nil(t, patch.validate())
+	patch.apply(&task)
+
+	assert.Equal(t, "after", task.Body)
+	assert.Equal(t, "reminder", task.Tags["kind"])
+	assert.True(t, task.RunAt.After(time.Now().Add(50*time.Second)))
+	assert.True(t, task.Delay > 50*time.Second)
+
+	invalid := taskPatch{}
+	assert.Nil(t, json.Unmarshal([]byte(`{"body": ""}`), &invalid))
+	assert.NotNil(t, invalid.validate())
+}
+
+func TestLeasedTask(t *testing.T) {
+	fixture := kewpie.Task{
+		Body: `{"hi": "` + uuid.NewV4().String() + `"}`,
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "tasktest", &fixture))
+
+	subreq, err := http.NewRequest("GET", "/queues/tasktest?lease=30s&wait=5s", nil)
+	assert.Nil(t, err)
+
+	subrr := httptest.NewRecorder()
+	Router()(subrr, subreq)
+	assert.Equal(t, http.StatusOK, subrr.Code)
+	token := subrr.Header().Get("Lease-Token")
+
+	getreq, err := http.NewRequest("GET", "/queues/tasktest/tasks/"+fixture.ID, nil)
+	assert.Nil(t, err)
+	getreq.Header.Set("Accept", "application/vnd.api+json")
+
+	getrr := httptest.NewRecorder()
+	Router()(getrr, getreq)
+
+	assert.Equal(t, http.StatusOK, getrr.Code)
+	res := jsonAPIPayload{}
+	assert.Nil(t, json.Unmarshal(getrr.Body.Bytes(), &res))
+	assert.Equal(t, fixture.Body, res.Data.Attributes.Body)
+	assert.NotEmpty(t, res.Meta["lease_expires"])
+	assert.Empty(t, res.Meta["lease_token"])
+
+	delreq, err := http.NewRequest("DELETE", "/queues/tasktest/tasks/"+fixture.ID, nil)
+	assert.Nil(t, err)
+
+	delrr := httptest.NewRecorder()
+	Router()(delrr, delreq)
+	assert.Equal(t, http.StatusConflict, delrr.Code)
+
+	patchreq, err := http.NewRequest("PATCH", "/queues/tasktest/tasks/"+fixture.ID, strings.NewReader(`{"delay": 60000000000}`))
+	assert.Nil(t, err)
+
+	patchrr := httptest.NewRecorder()
+	Router()(patchrr, patchreq)
+	assert.Equal(t, http.StatusConflict, patchrr.Code)
+
+	ackreq, err := http.NewRequest("POST", "/queues/tasktest/tasks/"+fixture.ID+"/ack", nil)
+	assert.Nil(t, err)
+	ackreq.Header.Set("Lease-Token", token)
+
+	ackrr := httptest.NewRecorder()
+	Router()(ackrr, ackreq)
+	assert.Equal(t, http.StatusOK, ackrr.Code)
+}
+
+func TestRescheduleTask(t *testing.T) {
+	if testServer.pg == nil {
+		req, err := http.NewRequest("GET", "/queues/tasktest/tasks/"+uuid.NewV4().String(), nil)
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusNotImplemented, rr.Code)
+		t.Skip("Fetching tasks by ID needs the postgres backend")
+	}
+
+	fixture := kewpie.Task{
+		Body:  `{"hi": "reminder"}`,
+		Delay: time.Hour,
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "tasktest", &fixture))
+
+	runAt := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	patchreq, err := http.NewRequest("PATCH", "/queues/tasktest/tasks/"+fixture.ID, strings.NewReader(`{"run_at": "`+runAt.Format(time.RFC3339)+`", "tags": {"moved": "true"}}`))
+	assert.Nil(t, err)
+
+	patchrr := httptest.NewRecorder()
+	Router()(patchrr, patchreq)
+
+	assert.Equal(t, http.StatusOK, patchrr.Code)
+
+	getreq, err := http.NewRequest("GET", "/queues/tasktest/tasks/"+fixture.ID, nil)
+	assert.Nil(t, err)
+
+	getrr := httptest.NewRecorder()
+	Router()(getrr, getreq)
+
+	assert.Equal(t, http.StatusOK, getrr.Code)
+	res := kewpie.Task{}
+	assert.Nil(t, json.Unmarshal(getrr.Body.Bytes(), &res))
+	assert.True(t, runAt.Equal(res.RunAt))
+	assert.Equal(t, "true", res.Tags["moved"])
+
+	delreq, err := http.NewRequest("DELETE", "/queues/tasktest/tasks/"+fixture.ID, nil)
+	assert.Nil(t, err)
+
+	delrr := httptest.NewRecorder()
+	Router()(delrr, delreq)
+	assert.Equal(t, http.StatusOK, delrr.Code)
+
+	gonerr := httptest.NewRecorder()
+	Router()(gonerr, getreq)
+	assert.Equal(t, http.StatusNotFound, gonerr.Code)
+}
+
+func TestTaskIDNotUUID(t *testing.T) {
+	for _, method := range []string{"GET", "DELETE", "PATCH"} {
+		req, err := http.NewRequest(method, "/queues/tasktest/tasks/not-a-uuid", strings.NewReader(`{"delay": 60000000000}`))
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		Router()(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code, method)
+	}
+}
@@ -0,0 +1,127 @@
+package kewpiehttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+)
+
+// webhookTimeout is how long a webhook target gets to respond before the
+// delivery counts as failed
+const webhookTimeout = 30 * time.Second
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+}
+
+type webhookHandler struct {
+	server    *server
+	queueName string
+	url       string
+}
+
+// Handle POSTs the task to the webhook target. Anything other than a 2xx counts
+// as a failed attempt.
+func (h webhookHandler) Handle(task kewpie.Task) (bool, error) {
+	if h.server.state.paused(h.queueName) {
+		// The queue was paused just as this one was popped
+		return h.server.putBack(h.queueName, task)
+	}
+
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return true, err
+	}
+
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(payload))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Kewpie-Queue", h.queueName)
+	req.Header.Set("Kewpie-Task-Id", task.ID)
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return h.server.failed(h.queueName, task, err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return h.server.failed(h.queueName, task, fmt.Errorf("Webhook target responded with %s", res.Status))
+	}
+
+	return false, nil
+}
+
+// deliverWebhooks subscribes to the named queue and POSTs every task to url
+// until ctx is done
+func (s *server) deliverWebhooks(ctx context.Context, queueName, url string) {
+	handler := webhookHandler{
+		server:    s,
+		queueName: queueName,
+		url:       url,
+	}
+
+	for {
+		if err := s.state.waitResumed(ctx, queueName); err != nil {
+			return
+		}
+
+		subCtx, cancel := s.state.untilPaused(ctx, queueName)
+		err := s.queue.Subscribe(subCtx, queueName, handler)
+		paused := subCtx.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if paused {
+			log.Println("INFO webhook delivery paused", queueName)
+			continue
+		}
+		log.Println("ERROR webhook subscription failed, resubscribing", queueName, err)
+
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *server) startWebhooks(ctx context.Context) {
+	for _, name := range s.queue.names() {
+		s.startWebhook(ctx, name)
+	}
+}
+
+// startWebhook delivers tasks from the named queue to its webhook, if it has
+// one, until ctx is done or the queue is unregistered or changed
+func (s *server) startWebhook(ctx context.Context, name string) {
+	settings, ok := s.queue.settingsFor(name)
+	if !ok || settings.Webhook == "" || ctx.Err() != nil {
+		return
+	}
+
+	queueCtx := s.queue.contextFor(name)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-queueCtx.Done():
+		case <-ctx.Done():
+		}
+	}()
+
+	log.Printf("INFO delivering tasks from %s to %s", name, settings.Webhook)
+	go s.deliverWebhooks(ctx, name, settings.Webhook)
+}
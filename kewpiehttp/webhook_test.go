@@ -0,0 +1,112 @@
+package kewpiehttp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	kewpie "github.com/davidbanham/kewpie_go"
+	"github.com/paidright/kewpie_http/config"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	if err := testServer.queue.Purge(context.Background(), "webhooktest"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	t.Parallel()
+
+	status := http.StatusOK
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer target.Close()
+
+	handler := webhookHandler{
+		server:    testServer,
+		queueName: "webhooktest",
+		url:       target.URL,
+	}
+
+	requeue, err := handler.Handle(kewpie.Task{})
+	assert.Nil(t, err)
+	assert.False(t, requeue)
+
+	status = http.StatusBadGateway
+	requeue, err = handler.Handle(kewpie.Task{})
+	assert.NotNil(t, err)
+	assert.True(t, requeue)
+
+	target.Close()
+	requeue, err = handler.Handle(kewpie.Task{})
+	assert.NotNil(t, err)
+	assert.True(t, requeue)
+
+	// A task that turns up after the queue is paused goes back on the queue as
+	// it was
+	paused := webhookHandler{
+		server:    memoryServer(t, map[string]config.QueueSettings{"pausedhook": {}}),
+		queueName: "pausedhook",
+		url:       target.URL,
+	}
+	assert.Nil(t, paused.server.state.pause("pausedhook"))
+	requeue, err = paused.Handle(kewpie.Task{Body: "paused", Attempts: 2})
+	assert.Nil(t, err)
+	assert.False(t, requeue)
+
+	assert.Nil(t, paused.server.state.resume("pausedhook"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	task, err := paused.server.claim(ctx, "pausedhook", func(kewpie.Task) (bool, error) {
+		return false, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "paused", task.Body)
+	assert.Equal(t, 2, task.Attempts)
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan kewpie.Task, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		task := kewpie.Task{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&task))
+		assert.Equal(t, "webhooktest", r.Header.Get("Kewpie-Queue"))
+		received <- task
+
+		// Fail the first delivery so that it gets requeued
+		if task.Attempts == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer target.Close()
+
+	fixture := kewpie.Task{
+		Body:         `{"hi": "` + uuid.NewV4().String() + `"}`,
+		NoExpBackoff: true,
+	}
+	assert.Nil(t, testServer.queue.Publish(context.Background(), "webhooktest", &fixture))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go testServer.deliverWebhooks(ctx, "webhooktest", target.URL)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		select {
+		case task := <-received:
+			assert.Equal(t, fixture.Body, task.Body)
+			assert.Equal(t, attempt, task.Attempts)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Webhook was not delivered")
+		}
+	}
+}